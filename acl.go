@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Permissions granted or denied by access control rules
+const (
+	permList   = "list"
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+	permShare  = "share"
+	permAdmin  = "admin" // implies every other permission
+)
+
+var allPerms = []string{permList, permRead, permWrite, permDelete, permShare, permAdmin}
+
+// defaultRoles are always available and can be redefined in the ACL file
+var defaultRoles = map[string][]string{
+	"viewer":  {permList, permRead},
+	"editor":  {permList, permRead, permWrite, permDelete},
+	"manager": {permList, permRead, permWrite, permDelete, permShare},
+}
+
+// aclRule grants or denies permissions on a path and everything below it.
+// Allow and deny lists may name permissions or roles.
+type aclRule struct {
+	Path   string   `json:"path"`
+	Users  []string `json:"users"`  // user names, "*" for everyone
+	Groups []string `json:"groups"` // group names
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+
+	fullPath string
+	allow    map[string]bool
+	deny     map[string]bool
+}
+
+// aclStore holds the rules from the ACL file, reloading it when the file
+// changes like the user store does
+type aclStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	groups  map[string][]string
+	rules   []*aclRule // deepest path first
+}
+
+// acl is the access control list, nil when every user may do everything
+var acl *aclStore
+
+// loadACL reads the ACL file, which must exist
+func loadACL(path string) (*aclStore, error) {
+	a := &aclStore{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the ACL file if it changed since the last read. A broken file
+// keeps the previous rules. a.mu must be held, or a not yet shared.
+func (a *aclStore) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Groups map[string][]string `json:"groups"`
+		Roles  map[string][]string `json:"roles"`
+		Rules  []*aclRule          `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %v", a.path, err)
+	}
+
+	roles := make(map[string][]string)
+	for name, perms := range defaultRoles {
+		roles[name] = perms
+	}
+	for name, perms := range file.Roles {
+		roles[name] = perms
+	}
+
+	for i, rule := range file.Rules {
+		if rule.fullPath, err = rootView.resolve(rule.Path); err != nil || rule.Path == "" {
+			return fmt.Errorf("%s: rule %d: invalid path %q", a.path, i+1, rule.Path)
+		}
+		if rule.allow, err = expandPerms(rule.Allow, roles); err != nil {
+			return fmt.Errorf("%s: rule %d: %v", a.path, i+1, err)
+		}
+		if rule.deny, err = expandPerms(rule.Deny, roles); err != nil {
+			return fmt.Errorf("%s: rule %d: %v", a.path, i+1, err)
+		}
+	}
+
+	// Deeper rules are more specific, so they are looked at first. Rules on
+	// the same path must be next to each other to be weighed together.
+	sort.SliceStable(file.Rules, func(i, j int) bool {
+		a, b := file.Rules[i].fullPath, file.Rules[j].fullPath
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+
+	a.groups = file.Groups
+	a.rules = file.Rules
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// expandPerms turns a list of permission and role names into a set of
+// permissions
+func expandPerms(names []string, roles map[string][]string) (map[string]bool, error) {
+	perms := make(map[string]bool)
+	for _, name := range names {
+		if perms[name] {
+			continue
+		}
+		if role, ok := roles[name]; ok {
+			for _, p := range role {
+				perms[p] = true
+			}
+			continue
+		}
+		known := false
+		for _, p := range allPerms {
+			known = known || p == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown permission or role %q", name)
+		}
+		perms[name] = true
+	}
+	return perms, nil
+}
+
+// current returns the rules and groups, picking up changes to the ACL file
+func (a *aclStore) current() ([]*aclRule, map[string][]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reload(); err != nil {
+		log.Printf("Failed to reload ACL, keeping previous rules: %v", err)
+	}
+	return a.rules, a.groups
+}
+
+// applies reports whether a rule names the user, directly or by group
+func (rule *aclRule) applies(u *User, groups map[string][]string) bool {
+	for _, name := range rule.Users {
+		if name == "*" || name == u.Name {
+			return true
+		}
+	}
+	for _, g := range rule.Groups {
+		for _, member := range groups[g] {
+			if member == u.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowed reports whether a user has perm on fullPath. The most specific
+// rules that mention perm decide, and at the same depth a deny beats an
+// allow. Without any matching rule access is denied. Admin users and users
+// with the admin permission may do everything, as may users in their own
+// home directory.
+func (a *aclStore) allowed(u *User, perm, fullPath string) bool {
+	if a == nil || u == nil || u.Admin {
+		return true
+	}
+	if config.UserHomes && isWithin(fullPath, homeDir(u.Name)) {
+		return true
+	}
+
+	rules, groups := a.current()
+	for i := 0; i < len(rules); {
+		// Rules on the same path form one level
+		depth := rules[i].fullPath
+		allow, deny := false, false
+		for ; i < len(rules) && rules[i].fullPath == depth; i++ {
+			rule := rules[i]
+			if !isWithin(fullPath, rule.fullPath) || !rule.applies(u, groups) {
+				continue
+			}
+			deny = deny || rule.deny[perm] || rule.deny[permAdmin]
+			allow = allow || rule.allow[perm] || rule.allow[permAdmin]
+		}
+		if deny {
+			return false
+		}
+		if allow {
+			return true
+		}
+	}
+	return false
+}
+
+// grantsBelow reports whether the user is allowed something somewhere below
+// dir, so dir must be browsable to get there even without list permission
+func (a *aclStore) grantsBelow(u *User, dir string) bool {
+	rules, groups := a.current()
+	for _, rule := range rules {
+		if rule.fullPath != dir && isWithin(rule.fullPath, dir) && len(rule.allow) > 0 && rule.applies(u, groups) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether a directory entry is shown to the user in listings
+func (a *aclStore) visible(u *User, fullPath string) bool {
+	if a == nil || u == nil || u.Admin {
+		return true
+	}
+	return a.allowed(u, permList, fullPath) || a.grantsBelow(u, fullPath)
+}
+
+// checkAccess makes sure the request's user has perm on every one of
+// fullPaths, sending a 403 if not
+func checkAccess(w http.ResponseWriter, r *http.Request, perm string, fullPaths ...string) bool {
+	user := currentUser(r)
+	for _, fullPath := range fullPaths {
+		if !acl.allowed(user, perm, fullPath) {
+			logf(r, "Denied %s on %s", perm, apiPath(r, fullPath))
+			w.Header().Set("Content-Type", "application/json")
+			sendJSONError(w, "Permission denied", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// checkTreeAccess is checkAccess for a path and everything below it, so a
+// rule deeper down that denies perm is not bypassed by acting on a parent
+func checkTreeAccess(w http.ResponseWriter, r *http.Request, perm, fullPath string) bool {
+	if !checkAccess(w, r, perm, fullPath) {
+		return false
+	}
+	allowed := accessFilter(r, perm)
+	if allowed == nil {
+		return true
+	}
+	denied := ""
+	walkStorage(fullPath, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && !allowed(path) {
+			denied = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return denied == "" || checkAccess(w, r, perm, denied)
+}
+
+// accessFilter returns a filter for tree walks that passes whatever the
+// request's user has perm on, or nil if nothing needs to be filtered
+func accessFilter(r *http.Request, perm string) func(fullPath string) bool {
+	user := currentUser(r)
+	if acl == nil || user == nil || user.Admin {
+		return nil
+	}
+	return func(fullPath string) bool {
+		return acl.allowed(user, perm, fullPath)
+	}
+}
+
+// readFilter returns a filter for tree walks that skips whatever the
+// request's user may not read, or nil if nothing needs to be skipped
+func readFilter(r *http.Request) func(fullPath string) bool {
+	return accessFilter(r, permRead)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormats maps the format parameter to the file extension and
+// content type of the archive
+var archiveFormats = map[string]struct {
+	ext         string
+	contentType string
+}{
+	"zip":    {".zip", "application/zip"},
+	"tar":    {".tar", "application/x-tar"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+}
+
+// archiveRoot is a file or directory to include in an archive under name
+type archiveRoot struct {
+	fullPath string
+	name     string
+}
+
+// archiveWriter abstracts over the zip and tar writers
+type archiveWriter interface {
+	add(name string, info fs.FileInfo, src io.Reader) error
+	Close() error
+}
+
+// handleArchiveSelection streams several paths as one archive. It takes
+// either a JSON body {"paths": [...], "format": "zip"} or form fields, so a
+// plain HTML form can trigger the download.
+func handleArchiveSelection(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Paths  []string `json:"paths"`
+		Format string   `json:"format"`
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		reqBody.Paths = r.PostForm["path"]
+		reqBody.Format = r.PostForm.Get("format")
+	}
+
+	if len(reqBody.Paths) == 0 {
+		http.Error(w, "No paths selected", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Format == "" {
+		reqBody.Format = "zip"
+	}
+
+	var roots []archiveRoot
+	used := make(map[string]bool)
+	for _, p := range reqBody.Paths {
+		// Make sure we're not accessing outside the upload directory
+		fullPath, err := resolvePath(r, p)
+		if err != nil {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		if !checkScope(w, r, scopeRead, fullPath) || !checkAccess(w, r, permRead, fullPath) {
+			return
+		}
+		if _, err := storage.Stat(fullPath); err != nil {
+			http.Error(w, "File not found: "+p, http.StatusNotFound)
+			return
+		}
+
+		// Entries with the same base name get a numbered suffix
+		name := filepath.Base(fullPath)
+		if isRoot(r, fullPath) {
+			name = "files"
+		}
+		for i := 1; used[name]; i++ {
+			ext := path.Ext(filepath.Base(fullPath))
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filepath.Base(fullPath), ext), i, ext)
+		}
+		used[name] = true
+
+		roots = append(roots, archiveRoot{fullPath, name})
+	}
+
+	name := "download"
+	if len(roots) == 1 {
+		name = roots[0].name
+	}
+	streamArchive(w, reqBody.Format, name, roots, readFilter(r))
+}
+
+// streamArchive writes the roots to the response as an archive, building it
+// on the fly without a temp file. If filter is set, only paths it accepts
+// are included.
+func streamArchive(w http.ResponseWriter, format, name string, roots []archiveRoot, filter func(fullPath string) bool) {
+	f, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "Format must be one of zip, tar or tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+f.ext))
+
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = &zipArchive{zip.NewWriter(w)}
+	case "tar":
+		aw = &tarArchive{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		aw = &tarArchive{tw: tar.NewWriter(gz), gz: gz}
+	}
+
+	for _, root := range roots {
+		if err := addToArchive(aw, root, filter); err != nil {
+			// Headers are already sent, so all we can do is cut the
+			// response short for the client to notice
+			log.Printf("Failed to write archive %s: %v", name, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		log.Printf("Failed to finish archive %s: %v", name, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// addToArchive adds a file or directory tree with paths relative to root
+func addToArchive(aw archiveWriter, root archiveRoot, filter func(fullPath string) bool) error {
+	return walkStorage(root.fullPath, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isInternalName(info.Name()) || (filter != nil && !filter(p)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root.fullPath, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(root.name, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return aw.add(name+"/", info, nil)
+		}
+
+		file, err := storage.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return aw.add(name, info, file)
+	})
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, info fs.FileInfo, src io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if src == nil {
+		_, err := a.zw.CreateHeader(header)
+		return err
+	}
+
+	header.Method = zip.Deflate
+	dst, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (a *tarArchive) add(name string, info fs.FileInfo, src io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if src == nil {
+		return nil
+	}
+
+	// Write exactly the size in the header even if the file changed meanwhile
+	n, err := io.Copy(a.tw, io.LimitReader(src, header.Size))
+	if err == nil && n < header.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account in the user store
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	Admin        bool   `json:"admin,omitempty"`
+}
+
+// userStore holds the accounts from the users file, reloading it when the
+// file changes so accounts can be managed without a restart
+type userStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]*User
+	mounts  []*Mount
+}
+
+// users is the account store, nil when authentication is disabled
+var users *userStore
+
+// dummyHash is compared against for unknown users so that a failed login
+// takes as long whether or not the name exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// loadUserStore opens the users file. A missing file is an empty store.
+func loadUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path, users: make(map[string]*User)}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the users file if it changed since the last read.
+// s.mu must be held, or s not yet shared.
+func (s *userStore) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.users = make(map[string]*User)
+		s.mounts = nil
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Users  []*User  `json:"users"`
+		Mounts []*Mount `json:"mounts"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+
+	loaded := make(map[string]*User, len(file.Users))
+	for _, u := range file.Users {
+		loaded[u.Name] = u
+	}
+	s.users = loaded
+	s.mounts = file.Mounts
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the store back to the users file. s.mu must be held.
+func (s *userStore) save() error {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+
+	file := map[string]interface{}{"users": list}
+	if len(s.mounts) > 0 {
+		file["mounts"] = s.mounts
+	}
+	return saveJSON(s.path, file)
+}
+
+// saveJSON replaces a file with v encoded as indented JSON, readable only by
+// the server's user. The file is written under a temporary name first so a
+// crash never leaves it half written.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// get returns a user by name, picking up changes to the users file
+func (s *userStore) get(name string) *User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Printf("Failed to reload users: %v", err)
+	}
+	return s.users[name]
+}
+
+// mountsFor returns the mounts given to a user, directly or through one of
+// the groups
+func (s *userStore) mountsFor(u *User, groups map[string][]string) []*Mount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []*Mount
+	for _, m := range s.mounts {
+		if mountApplies(m, u, groups) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// mountApplies reports whether a mount names the user, directly or by group
+func mountApplies(m *Mount, u *User, groups map[string][]string) bool {
+	for _, name := range m.Users {
+		if name == "*" || name == u.Name {
+			return true
+		}
+	}
+	for _, g := range m.Groups {
+		for _, member := range groups[g] {
+			if member == u.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks a name and password, returning the user on success
+func (s *userStore) verify(name, password string) *User {
+	u := s.get(name)
+	hash := dummyHash
+	if u != nil {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || u == nil {
+		return nil
+	}
+	return u
+}
+
+// session is a logged-in browser
+type session struct {
+	user      string
+	csrfToken string
+	expires   time.Time
+}
+
+const sessionCookie = "gofs_session"
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[string]*session)
+)
+
+// newSession logs a user in and returns the session token
+func newSession(user string) string {
+	token := randomID()
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for t, s := range sessions {
+		if time.Now().After(s.expires) {
+			delete(sessions, t)
+		}
+	}
+	sessions[token] = &session{
+		user:      user,
+		csrfToken: randomID(),
+		expires:   time.Now().Add(config.SessionTTL),
+	}
+	return token
+}
+
+// sessionFromRequest returns the session of the request's cookie, if valid
+func sessionFromRequest(r *http.Request) (string, *session) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", nil
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := sessions[cookie.Value]
+	if s == nil || time.Now().After(s.expires) {
+		delete(sessions, cookie.Value)
+		return "", nil
+	}
+	return cookie.Value, s
+}
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	tokenKey
+	viewKey
+)
+
+// currentUser returns the authenticated user of a request, or nil when
+// authentication is disabled
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey).(*User)
+	return u
+}
+
+// logf logs an action together with who performed it
+func logf(r *http.Request, format string, args ...interface{}) {
+	who := "anonymous"
+	if t := currentToken(r); t != nil {
+		who = fmt.Sprintf("token %s (%s) of %s", t.ID, t.Name, t.User)
+	} else if u := currentUser(r); u != nil {
+		who = "user " + u.Name
+	}
+	log.Printf("%s: %s", who, fmt.Sprintf(format, args...))
+}
+
+// requireAuth wraps a handler so it only runs for authenticated requests.
+// Scripts use HTTP Basic or an API token; browsers use the session cookie,
+// and must echo the session's CSRF token on anything that changes state.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// A signed URL stands in for any login, for the one method and path
+		// it was signed for. The request has no user and sees the whole
+		// upload directory; access was checked when the URL was signed.
+		if signingKeys != nil && r.URL.Query().Has("sig") {
+			key, err := verifySignedURL(r)
+			if err != nil {
+				log.Printf("Rejected signed URL %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				w.Header().Set("Content-Type", "application/json")
+				sendJSONError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			log.Printf("Signed URL (key %s): %s %s from %s", key.ID, r.Method, r.URL.Path, r.RemoteAddr)
+			next(w, r)
+			return
+		}
+
+		if users == nil {
+			next(w, r)
+			return
+		}
+
+		user, token, err := authenticate(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			status := http.StatusUnauthorized
+			if errors.Is(err, errCSRF) {
+				status = http.StatusForbidden
+			} else if _, s := sessionFromRequest(r); s == nil && r.Header.Get("Sec-Fetch-Mode") == "" {
+				// Only prompt clients such as curl or wget for credentials.
+				// Browsers sign in with the form, and would otherwise keep
+				// sending the credentials along with requests from other
+				// sites.
+				w.Header().Set("WWW-Authenticate", `Basic realm="File Server", charset="UTF-8"`)
+			}
+			sendJSONError(w, err.Error(), status)
+			return
+		}
+
+		ctx := withView(context.WithValue(r.Context(), userKey, user), user)
+		if token != nil {
+			ctx = context.WithValue(ctx, tokenKey, token)
+		}
+		r = r.WithContext(ctx)
+
+		// Token use is always logged, so scripted changes can be traced
+		if token != nil {
+			logf(r, "%s %s", r.Method, r.URL.RequestURI())
+		}
+		next(w, r)
+	}
+}
+
+var (
+	errUnauthenticated = errors.New("Authentication required")
+	errBadCredentials  = errors.New("Invalid username or password")
+	errCSRF            = errors.New("Invalid CSRF token")
+)
+
+// authenticate identifies the user of a request, and the API token if one
+// was used
+func authenticate(r *http.Request) (*User, *APIToken, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return authenticateToken(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	// Browsers may remember Basic credentials and send them like cookies,
+	// so changes coming from another site are refused as for certificates
+	if name, password, ok := r.BasicAuth(); ok {
+		u := users.verify(name, password)
+		if u == nil {
+			return nil, nil, errBadCredentials
+		}
+		if !safeMethod(r) && crossSite(r) {
+			return nil, nil, errCSRF
+		}
+		return u, nil, nil
+	}
+
+	_, s := sessionFromRequest(r)
+	if s == nil {
+		return authenticateCert(r)
+	}
+	u := users.get(s.user)
+	if u == nil {
+		return nil, nil, errUnauthenticated
+	}
+
+	if !safeMethod(r) {
+		// Only plain forms are parsed here, multipart uploads are streamed
+		// by the handlers and must not be read ahead
+		token := r.Header.Get("X-CSRF-Token")
+		if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			token = r.PostFormValue("csrf_token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken)) != 1 {
+			return nil, nil, errCSRF
+		}
+	}
+	return u, nil, nil
+}
+
+// authenticateCert identifies the user of a verified client certificate.
+// Browsers send certificates with every request like cookies, so changes
+// coming from another site are refused.
+func authenticateCert(r *http.Request) (*User, *APIToken, error) {
+	u, err := certUser(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u == nil {
+		return nil, nil, errUnauthenticated
+	}
+
+	if !safeMethod(r) && crossSite(r) {
+		return nil, nil, errCSRF
+	}
+	return u, nil, nil
+}
+
+// safeMethod reports whether a request only reads
+func safeMethod(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// crossSite reports whether the browser marked a request as coming from
+// another site. Clients other than browsers send no Sec-Fetch-Site.
+func crossSite(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	return site != "" && site != "same-origin" && site != "none"
+}
+
+// startSession logs a user in and sets the session cookie
+func startSession(w http.ResponseWriter, r *http.Request, u *User) *session {
+	token := newSession(u.Name)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(config.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[token]
+}
+
+// handleLogin checks the login form and starts a session
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || users == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	name := r.PostFormValue("username")
+	u := users.verify(name, r.PostFormValue("password"))
+	if u == nil {
+		log.Printf("Failed login for %q from %s", name, r.RemoteAddr)
+		http.Redirect(w, r, "/?login_error=1", http.StatusFound)
+		return
+	}
+
+	startSession(w, r, u)
+	log.Printf("User %s logged in from %s", u.Name, r.RemoteAddr)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleLogout ends the browser session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, s := sessionFromRequest(r)
+	if s != nil {
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf_token")), []byte(s.csrfToken)) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		sessionsMu.Lock()
+		delete(sessions, token)
+		sessionsMu.Unlock()
+		log.Printf("User %s logged out", s.user)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// runUserCommand manages the users file from the command line:
+//
+//	user add <name> [admin]   add or update a user, password read from stdin
+//	user remove <name>        delete a user
+//	user list                 list users
+func runUserCommand(args []string) error {
+	if config.UsersFile == "" {
+		return errors.New("users-file is not configured")
+	}
+	store, err := loadUserStore(config.UsersFile)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(args) == 0 {
+		return errors.New("usage: user add <name> [admin] | user remove <name> | user list")
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		names := make([]string, 0, len(store.users))
+		for name, u := range store.users {
+			if u.Admin {
+				name += " (admin)"
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3 && args[2] == "admin"):
+		if !validUserName(args[1]) {
+			return fmt.Errorf("invalid user name %q", args[1])
+		}
+		fmt.Fprintf(os.Stderr, "Password for %s: ", args[1])
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			return fmt.Errorf("failed to read password: %v", err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return errors.New("password must not be empty")
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		store.users[args[1]] = &User{Name: args[1], PasswordHash: string(hash), Admin: len(args) == 3}
+		return store.save()
+
+	case args[0] == "remove" && len(args) == 2:
+		if store.users[args[1]] == nil {
+			return fmt.Errorf("no user %q", args[1])
+		}
+		delete(store.users, args[1])
+		return store.save()
+
+	default:
+		return errors.New("usage: user add <name> [admin] | user remove <name> | user list")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With content-addressed storage every distinct content is stored once, as
+// a blob named by its SHA-256 below blobDirName, and files in the upload
+// directory are hard links to their blob. Listing and downloading need no
+// translation, a blob's references are its link count minus the blob
+// itself, and a blob with no other name left is garbage. The server never
+// writes into an existing file, so linked files cannot change each other.
+// Files sharing a blob also share its permissions and modification time.
+const blobDirName = internalPrefix + "blobs"
+
+// blobPath returns where the blob with a hex SHA-256 is stored
+func blobPath(sum string) string {
+	return filepath.Join(config.UploadPath, blobDirName, sum[:2], sum)
+}
+
+// internFile makes the finished file at src a reference to the blob of its
+// content: if the blob exists, src is replaced by a link to it, otherwise
+// src becomes the blob. Without content-addressed storage it does nothing.
+// Failures only cost the deduplication, so they are logged and src is kept.
+func internFile(src, sum string) {
+	if !config.ContentAddressed || len(sum) != 64 {
+		return
+	}
+	blob := blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		log.Printf("Failed to create blob directory: %v", err)
+		return
+	}
+
+	err := os.Link(src, blob)
+	if err == nil || !os.IsExist(err) {
+		if err != nil {
+			log.Printf("Failed to store blob %s: %v", sum, err)
+		}
+		return
+	}
+
+	// The content is stored already. Link it next to src first, so src is
+	// only replaced once that worked.
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+	blobInfo, err := os.Stat(blob)
+	if err != nil || os.SameFile(srcInfo, blobInfo) || blobInfo.Size() != srcInfo.Size() {
+		return
+	}
+	link := src + ".blob"
+	if err := os.Link(blob, link); err != nil {
+		log.Printf("Failed to link blob %s: %v", sum, err)
+		return
+	}
+	if err := os.Rename(link, src); err != nil {
+		os.Remove(link)
+		log.Printf("Failed to link blob %s: %v", sum, err)
+	}
+}
+
+// internPending interns a pending file of the local storage before it is
+// committed
+func internPending(pending PendingFile, sum string) {
+	p, ok := pending.(*localPending)
+	if !ok || !config.ContentAddressed || p.finish() != nil {
+		return
+	}
+	internFile(p.name, sum)
+}
+
+// linkBlob copies a file that is a reference to a blob by adding another
+// reference, and reports whether it did
+func linkBlob(src, dst string, info fs.FileInfo) bool {
+	if !config.ContentAddressed {
+		return false
+	}
+	meta := readMeta(src, info)
+	if meta == nil || len(meta.Hashes[hashSHA256]) != 64 {
+		return false
+	}
+	blob := blobPath(meta.Hashes[hashSHA256])
+	blobInfo, err := os.Stat(blob)
+	if err != nil || !os.SameFile(info, blobInfo) {
+		return false
+	}
+	if err := os.Link(blob, dst); err != nil {
+		return false
+	}
+	writeMeta(dst, meta.Uploader, meta.Hashes)
+	return true
+}
+
+// BlobStats reports how much space content-addressed storage takes and
+// saves
+type BlobStats struct {
+	Blobs             int   `json:"blobs"`
+	References        int64 `json:"references"`
+	StoredBytes       int64 `json:"stored_bytes"`  // size of the referenced blobs
+	LogicalBytes      int64 `json:"logical_bytes"` // size of all references together
+	SavedBytes        int64 `json:"saved_bytes"`
+	Unreferenced      int   `json:"unreferenced"`
+	UnreferencedBytes int64 `json:"unreferenced_bytes"`
+}
+
+// walkBlobs calls fn for every blob
+func walkBlobs(fn func(path string, info fs.FileInfo)) {
+	root := filepath.Join(config.UploadPath, blobDirName)
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			fn(p, info)
+		}
+		return nil
+	})
+}
+
+// blobStats counts the blobs and their references
+func blobStats() BlobStats {
+	var stats BlobStats
+	walkBlobs(func(p string, info fs.FileInfo) {
+		refs := int64(linkCount(info)) - 1
+		if refs <= 0 {
+			stats.Unreferenced++
+			stats.UnreferencedBytes += info.Size()
+			return
+		}
+		stats.Blobs++
+		stats.References += refs
+		stats.StoredBytes += info.Size()
+		stats.LogicalBytes += info.Size() * refs
+	})
+	stats.SavedBytes = stats.LogicalBytes - stats.StoredBytes
+	return stats
+}
+
+// collectBlobs removes blobs nothing refers to any more, such as those of
+// deleted or overwritten files, and returns how many bytes that freed
+func collectBlobs() int64 {
+	var freed int64
+	walkBlobs(func(p string, info fs.FileInfo) {
+		if linkCount(info) > 1 {
+			return
+		}
+		if err := os.Remove(p); err == nil {
+			freed += info.Size()
+			os.Remove(filepath.Dir(p)) // only succeeds once it is empty
+		}
+	})
+	if freed > 0 {
+		log.Printf("Removed unreferenced blobs, freed %d bytes", freed)
+	}
+	return freed
+}
+
+// dedupeTree interns every file in the upload directory that is not yet a
+// reference to a blob, as left by uploads before content-addressed storage
+// was enabled. It returns how many files it interned.
+func dedupeTree() (int, error) {
+	count := 0
+	err := filepath.WalkDir(config.UploadPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isInternalName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || linkCount(info) > 1 {
+			return nil
+		}
+
+		meta := readMeta(p, info)
+		if meta == nil || meta.Hashes[hashSHA256] == "" {
+			sums, err := hashFile(p, nil)
+			if err != nil {
+				return nil
+			}
+			meta = &fileMeta{Hashes: sums}
+		}
+		internFile(p, meta.Hashes[hashSHA256])
+		// A link to an existing blob takes on its modification time
+		writeMeta(p, meta.Uploader, meta.Hashes)
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// handleAPIStorage reports the space content-addressed storage saves. Only
+// admins may see it.
+func handleAPIStorage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.ContentAddressed {
+		sendJSONError(w, "Content-addressed storage is not enabled", http.StatusNotFound)
+		return
+	}
+	if u := currentUser(r); u != nil && !u.Admin {
+		sendJSONError(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if !checkScope(w, r, scopeRead) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"storage": blobStats(),
+	})
+}
+
+// runBlobsCommand handles "blobs stats", "blobs gc" and "blobs dedupe"
+func runBlobsCommand(args []string) error {
+	if !config.ContentAddressed {
+		return errors.New("content-addressed is not enabled")
+	}
+	usage := errors.New("usage: blobs stats | blobs gc | blobs dedupe")
+	if len(args) != 1 {
+		return usage
+	}
+
+	switch args[0] {
+	case "stats":
+		s := blobStats()
+		fmt.Printf("%d blobs, %d references\n", s.Blobs, s.References)
+		fmt.Printf("stored %s for %s of files, saving %s\n", humanSize(s.StoredBytes), humanSize(s.LogicalBytes), humanSize(s.SavedBytes))
+		if s.Unreferenced > 0 {
+			fmt.Printf("%d unreferenced blobs (%s) waiting to be collected\n", s.Unreferenced, humanSize(s.UnreferencedBytes))
+		}
+		return nil
+
+	case "gc":
+		fmt.Printf("Freed %s\n", humanSize(collectBlobs()))
+		return nil
+
+	case "dedupe":
+		n, err := dedupeTree()
+		if err != nil {
+			return err
+		}
+		s := blobStats()
+		fmt.Printf("Interned %d files, now saving %s\n", n, humanSize(s.SavedBytes))
+		return nil
+	}
+	return usage
+}
+
+// humanSize formats a byte count for people
+func humanSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", size), ".0") + " " + units[i]
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// casSupported reports whether content-addressed storage works here; it
+// needs the link count of files
+const casSupported = true
+
+// linkCount returns how many names a file has
+func linkCount(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime configuration of the server
+type Config struct {
+	UploadPath    string        // Base directory for all uploads
+	Storage       string        // Backend holding the files below UploadPath: local or memory
+	Address       string        // Bind address, empty means all interfaces
+	Port          int           // Server port
+	MaxUploadSize int64         // Largest accepted upload body in bytes, 0 for no limit
+	DirPerm       os.FileMode   // Permissions for created directories
+	FilePerm      os.FileMode   // Permissions for created files
+	TimeFormat    string        // Layout used for timestamps in API responses
+	TusExpiry     time.Duration // How long an unfinished resumable upload is kept
+
+	UploadConflict string   // What an upload does when the file exists: fail, overwrite or rename
+	HashAlgorithms []string // Content hashes computed for uploads; sha256 is always included
+
+	ContentAddressed bool // Store each distinct file content once, shared by hard links
+
+	ExtractMaxSize    int64 // Most bytes one archive may extract to, 0 for no limit
+	ExtractMaxEntries int64 // Most entries one archive may contain, 0 for no limit
+
+	UsersFile  string        // JSON user store, empty disables authentication
+	TokensFile string        // JSON API token store, empty disables tokens
+	ACLFile    string        // JSON access control rules, empty gives every user full access
+	UserHomes  bool          // Give each non-admin user their own root directory
+	SharesFile string        // JSON share link store, empty disables sharing
+	SessionTTL time.Duration // How long a browser login lasts
+
+	SigningKeysFile string        // JSON store of URL signing keys, empty disables signed URLs
+	SignedURLMaxTTL time.Duration // Longest validity of a signed URL, also the default
+
+	TLSCert          string // PEM certificate file, enables HTTPS
+	TLSKey           string // PEM private key file for TLSCert
+	TLSSelfSigned    bool   // Serve HTTPS with a generated self-signed certificate
+	TLSClientCA      string // PEM CA file for client certificates, empty disables them
+	HTTPRedirectPort int    // Plain HTTP port redirecting to HTTPS, 0 for none
+
+	ShutdownTimeout time.Duration // How long running requests may take to finish on shutdown
+
+	TrashRetention time.Duration // How long deleted items are kept in the trash, 0 disables it
+
+	VersionsKeep   int           // Previous versions kept per file, 0 disables versioning
+	VersionsMaxAge time.Duration // How long previous versions are kept, 0 for no limit
+}
+
+// config is the effective configuration, set once at startup
+var config = defaultConfig()
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() *Config {
+	return &Config{
+		UploadPath:    "./uploads",
+		Storage:       "local",
+		Port:          8080,
+		MaxUploadSize: 10 << 30,
+		DirPerm:       0755,
+		FilePerm:      0644,
+		TimeFormat:    "2006-01-02 15:04:05",
+		TusExpiry:     24 * time.Hour,
+
+		UploadConflict: conflictOverwrite,
+		HashAlgorithms: []string{hashSHA256},
+
+		ExtractMaxSize:    10 << 30,
+		ExtractMaxEntries: 100000,
+
+		SessionTTL: 12 * time.Hour,
+
+		SignedURLMaxTTL: 7 * 24 * time.Hour,
+
+		ShutdownTimeout: 30 * time.Second,
+
+		TrashRetention: 30 * 24 * time.Hour,
+
+		VersionsKeep: 10,
+	}
+}
+
+// setting describes a single configuration option. The same name is used for
+// the command-line flag, the config file key (with dashes replaced by
+// underscores) and the GOFS_* environment variable.
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+	get   func(c *Config) string
+}
+
+var settings = []setting{
+	{
+		name:  "upload-path",
+		usage: "base directory for all uploads",
+		set:   func(c *Config, v string) error { c.UploadPath = v; return nil },
+		get:   func(c *Config) string { return c.UploadPath },
+	},
+	{
+		name:  "storage",
+		usage: "backend holding the files: local for the upload directory on disk, memory for a scratch store that is lost on exit",
+		set:   func(c *Config, v string) error { c.Storage = v; return nil },
+		get:   func(c *Config) string { return c.Storage },
+	},
+	{
+		name:  "address",
+		usage: "address to bind to (empty for all interfaces)",
+		set:   func(c *Config, v string) error { c.Address = v; return nil },
+		get:   func(c *Config) string { return c.Address },
+	},
+	{
+		name:  "port",
+		usage: "port to listen on",
+		set: func(c *Config, v string) (err error) {
+			c.Port, err = strconv.Atoi(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.Port) },
+	},
+	{
+		name:  "max-upload-size",
+		usage: "largest accepted upload in bytes, 0 for no limit (accepts KB, MB, GB suffixes)",
+		set: func(c *Config, v string) (err error) {
+			c.MaxUploadSize, err = parseSize(v)
+			return err
+		},
+		get: func(c *Config) string { return formatSize(c.MaxUploadSize) },
+	},
+	{
+		name:  "dir-perm",
+		usage: "permissions for created directories (octal)",
+		set: func(c *Config, v string) (err error) {
+			c.DirPerm, err = parsePerm(v)
+			return err
+		},
+		get: func(c *Config) string { return fmt.Sprintf("%04o", c.DirPerm) },
+	},
+	{
+		name:  "file-perm",
+		usage: "permissions for created files (octal)",
+		set: func(c *Config, v string) (err error) {
+			c.FilePerm, err = parsePerm(v)
+			return err
+		},
+		get: func(c *Config) string { return fmt.Sprintf("%04o", c.FilePerm) },
+	},
+	{
+		name:  "time-format",
+		usage: "Go time layout for timestamps in API responses",
+		set:   func(c *Config, v string) error { c.TimeFormat = v; return nil },
+		get:   func(c *Config) string { return c.TimeFormat },
+	},
+	{
+		name:  "tus-expiry",
+		usage: "how long an unfinished resumable upload is kept (e.g. 24h)",
+		set: func(c *Config, v string) (err error) {
+			c.TusExpiry, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.TusExpiry.String() },
+	},
+	{
+		name:  "upload-conflict",
+		usage: "what an upload does when the file already exists unless it asks otherwise: fail, overwrite or rename",
+		set:   func(c *Config, v string) error { c.UploadConflict = v; return nil },
+		get:   func(c *Config) string { return c.UploadConflict },
+	},
+	{
+		name:  "hash-algorithms",
+		usage: "content hashes computed for uploads, comma separated: sha256, md5, blake3 (sha256 is always computed)",
+		set: func(c *Config, v string) error {
+			c.HashAlgorithms = nil
+			for _, algo := range strings.Split(v, ",") {
+				if algo = strings.ToLower(strings.TrimSpace(algo)); algo != "" {
+					c.HashAlgorithms = append(c.HashAlgorithms, algo)
+				}
+			}
+			return nil
+		},
+		get: func(c *Config) string { return strings.Join(c.HashAlgorithms, ",") },
+	},
+	{
+		name:  "content-addressed",
+		usage: "store each distinct file content once, with identical files sharing it through hard links",
+		set: func(c *Config, v string) (err error) {
+			c.ContentAddressed, err = strconv.ParseBool(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.ContentAddressed) },
+	},
+	{
+		name:  "extract-max-size",
+		usage: "most bytes one archive may extract to, 0 for no limit (accepts KB, MB, GB suffixes)",
+		set: func(c *Config, v string) (err error) {
+			c.ExtractMaxSize, err = parseSize(v)
+			return err
+		},
+		get: func(c *Config) string { return formatSize(c.ExtractMaxSize) },
+	},
+	{
+		name:  "extract-max-entries",
+		usage: "most entries one archive may contain, 0 for no limit",
+		set: func(c *Config, v string) (err error) {
+			c.ExtractMaxEntries, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatInt(c.ExtractMaxEntries, 10) },
+	},
+	{
+		name:  "users-file",
+		usage: "JSON file of user accounts, empty disables authentication",
+		set:   func(c *Config, v string) error { c.UsersFile = v; return nil },
+		get:   func(c *Config) string { return c.UsersFile },
+	},
+	{
+		name:  "tokens-file",
+		usage: "JSON file of API tokens, empty disables tokens (requires users-file)",
+		set:   func(c *Config, v string) error { c.TokensFile = v; return nil },
+		get:   func(c *Config) string { return c.TokensFile },
+	},
+	{
+		name:  "acl-file",
+		usage: "JSON file of access control rules, empty gives every user full access (requires users-file)",
+		set:   func(c *Config, v string) error { c.ACLFile = v; return nil },
+		get:   func(c *Config) string { return c.ACLFile },
+	},
+	{
+		name:  "user-homes",
+		usage: "give each non-admin user their own root under upload-path/users/<name> (requires users-file)",
+		set: func(c *Config, v string) (err error) {
+			c.UserHomes, err = strconv.ParseBool(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.UserHomes) },
+	},
+	{
+		name:  "shares-file",
+		usage: "JSON file of public share links, empty disables sharing",
+		set:   func(c *Config, v string) error { c.SharesFile = v; return nil },
+		get:   func(c *Config) string { return c.SharesFile },
+	},
+	{
+		name:  "session-ttl",
+		usage: "how long a browser login lasts (e.g. 12h)",
+		set: func(c *Config, v string) (err error) {
+			c.SessionTTL, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.SessionTTL.String() },
+	},
+	{
+		name:  "signing-keys-file",
+		usage: "JSON file of keys for signed URLs, created if missing; empty disables signed URLs",
+		set:   func(c *Config, v string) error { c.SigningKeysFile = v; return nil },
+		get:   func(c *Config) string { return c.SigningKeysFile },
+	},
+	{
+		name:  "signed-url-max-ttl",
+		usage: "longest validity of a signed URL, also the default (e.g. 168h)",
+		set: func(c *Config, v string) (err error) {
+			c.SignedURLMaxTTL, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.SignedURLMaxTTL.String() },
+	},
+	{
+		name:  "tls-cert",
+		usage: "PEM certificate file to serve HTTPS with, reloaded when it changes",
+		set:   func(c *Config, v string) error { c.TLSCert = v; return nil },
+		get:   func(c *Config) string { return c.TLSCert },
+	},
+	{
+		name:  "tls-key",
+		usage: "PEM private key file for tls-cert",
+		set:   func(c *Config, v string) error { c.TLSKey = v; return nil },
+		get:   func(c *Config) string { return c.TLSKey },
+	},
+	{
+		name:  "tls-self-signed",
+		usage: "serve HTTPS with a generated self-signed certificate",
+		set: func(c *Config, v string) (err error) {
+			c.TLSSelfSigned, err = strconv.ParseBool(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatBool(c.TLSSelfSigned) },
+	},
+	{
+		name:  "tls-client-ca",
+		usage: "PEM CA file; client certificates it signed log in as the user named by their common name",
+		set:   func(c *Config, v string) error { c.TLSClientCA = v; return nil },
+		get:   func(c *Config) string { return c.TLSClientCA },
+	},
+	{
+		name:  "http-redirect-port",
+		usage: "plain HTTP port that redirects to HTTPS, 0 for none",
+		set: func(c *Config, v string) (err error) {
+			c.HTTPRedirectPort, err = strconv.Atoi(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.HTTPRedirectPort) },
+	},
+	{
+		name:  "shutdown-timeout",
+		usage: "how long running uploads and downloads may take to finish on shutdown (e.g. 30s)",
+		set: func(c *Config, v string) (err error) {
+			c.ShutdownTimeout, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.ShutdownTimeout.String() },
+	},
+	{
+		name:  "trash-retention",
+		usage: "how long deleted items are kept in the trash before they are purged, 0 deletes right away (e.g. 720h)",
+		set: func(c *Config, v string) (err error) {
+			c.TrashRetention, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.TrashRetention.String() },
+	},
+	{
+		name:  "versions-keep",
+		usage: "how many previous versions of an overwritten file are kept, 0 disables versioning",
+		set: func(c *Config, v string) (err error) {
+			c.VersionsKeep, err = strconv.Atoi(v)
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.VersionsKeep) },
+	},
+	{
+		name:  "versions-max-age",
+		usage: "how long previous versions are kept, 0 for no limit (e.g. 2160h)",
+		set: func(c *Config, v string) (err error) {
+			c.VersionsMaxAge, err = time.ParseDuration(v)
+			return err
+		},
+		get: func(c *Config) string { return c.VersionsMaxAge.String() },
+	},
+}
+
+// envName returns the environment variable for a setting name
+func envName(name string) string {
+	return "GOFS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// fileKey returns the config file key for a setting name
+func fileKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// loadConfig builds the configuration from defaults, an optional config file,
+// GOFS_* environment variables and command-line flags, in increasing order of
+// precedence. Arguments left after the flags are returned as a subcommand.
+func loadConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("file_server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("GOFS_CONFIG"), "path to a JSON, YAML or TOML config file")
+
+	// Flag values are collected as strings and applied last
+	flagValues := make(map[string]*string)
+	defaults := defaultConfig()
+	for _, s := range settings {
+		flagValues[s.name] = fs.String(s.name, s.get(defaults), s.usage+" (env "+envName(s.name)+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := defaultConfig()
+
+	// Config file
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		known := make(map[string]bool)
+		for _, s := range settings {
+			known[fileKey(s.name)] = true
+			if v, ok := values[fileKey(s.name)]; ok {
+				if err := s.set(cfg, v); err != nil {
+					return nil, nil, fmt.Errorf("%s: invalid %s: %v", *configFile, fileKey(s.name), err)
+				}
+			}
+		}
+		for key := range values {
+			if !known[key] {
+				return nil, nil, fmt.Errorf("%s: unknown setting %q", *configFile, key)
+			}
+		}
+	}
+
+	// Environment variables
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(envName(s.name)); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %v", envName(s.name), err)
+			}
+		}
+	}
+
+	// Flags, only those given explicitly
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && flagErr == nil {
+				if err := s.set(cfg, *flagValues[s.name]); err != nil {
+					flagErr = fmt.Errorf("invalid -%s: %v", s.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// validate checks that the configuration is usable
+func (c *Config) validate() error {
+	if c.UploadPath == "" {
+		return errors.New("upload-path must not be empty")
+	}
+	if _, ok := storageBackends[c.Storage]; !ok {
+		return fmt.Errorf("unknown storage %q, must be one of %s", c.Storage, strings.Join(storageNames(), ", "))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port %d out of range", c.Port)
+	}
+	if c.MaxUploadSize < 0 {
+		return errors.New("max-upload-size must not be negative")
+	}
+	if c.DirPerm&0700 != 0700 {
+		return fmt.Errorf("dir-perm %04o must grant the owner rwx", c.DirPerm)
+	}
+	if c.FilePerm&0600 != 0600 {
+		return fmt.Errorf("file-perm %04o must grant the owner rw", c.FilePerm)
+	}
+	if c.TimeFormat == "" {
+		return errors.New("time-format must not be empty")
+	}
+	if c.TusExpiry <= 0 {
+		return errors.New("tus-expiry must be positive")
+	}
+	if c.UploadConflict != conflictFail && c.UploadConflict != conflictOverwrite && c.UploadConflict != conflictRename {
+		return errors.New("upload-conflict must be one of fail, overwrite or rename")
+	}
+	if c.ContentAddressed && !casSupported {
+		return errors.New("content-addressed is not supported on this platform")
+	}
+	if c.ContentAddressed && c.Storage != "local" {
+		return errors.New("content-addressed requires local storage")
+	}
+	for _, algo := range c.HashAlgorithms {
+		if newHash(algo) == nil {
+			return fmt.Errorf("unknown hash algorithm %q, must be one of sha256, md5 or blake3", algo)
+		}
+	}
+	if c.ExtractMaxSize < 0 || c.ExtractMaxEntries < 0 {
+		return errors.New("extract limits must not be negative")
+	}
+	if c.TokensFile != "" && c.UsersFile == "" {
+		return errors.New("tokens-file requires users-file")
+	}
+	if c.ACLFile != "" && c.UsersFile == "" {
+		return errors.New("acl-file requires users-file")
+	}
+	if c.UserHomes && c.UsersFile == "" {
+		return errors.New("user-homes requires users-file")
+	}
+	if c.SessionTTL <= 0 {
+		return errors.New("session-ttl must be positive")
+	}
+	if c.SignedURLMaxTTL <= 0 {
+		return errors.New("signed-url-max-ttl must be positive")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown-timeout must not be negative")
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash-retention must not be negative")
+	}
+	if c.VersionsKeep < 0 {
+		return errors.New("versions-keep must not be negative")
+	}
+	if c.VersionsMaxAge < 0 {
+		return errors.New("versions-max-age must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key must be given together")
+	}
+	if c.TLSCert != "" && c.TLSSelfSigned {
+		return errors.New("tls-self-signed cannot be combined with tls-cert")
+	}
+	if c.TLSClientCA != "" && (!c.tlsEnabled() || c.UsersFile == "") {
+		return errors.New("tls-client-ca requires TLS and users-file")
+	}
+	if c.HTTPRedirectPort != 0 {
+		if !c.tlsEnabled() {
+			return errors.New("http-redirect-port requires TLS")
+		}
+		if c.HTTPRedirectPort < 1 || c.HTTPRedirectPort > 65535 || c.HTTPRedirectPort == c.Port {
+			return fmt.Errorf("http-redirect-port %d out of range or same as port", c.HTTPRedirectPort)
+		}
+	}
+	return nil
+}
+
+// listenAddr returns the address passed to the HTTP listener
+func (c *Config) listenAddr() string {
+	return fmt.Sprintf("%s:%d", c.Address, c.Port)
+}
+
+// readConfigFile reads a flat config file. JSON files are decoded as an object
+// of scalars; YAML and TOML files are read as simple "key: value" or
+// "key = value" lines, which covers everything the server needs.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return readJSONConfig(f, path)
+	case ".yaml", ".yml":
+		return readFlatConfig(f, path, ":")
+	case ".toml":
+		return readFlatConfig(f, path, "=")
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file type (use .json, .yaml or .toml)", path)
+	}
+}
+
+func readJSONConfig(r io.Reader, path string) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, key)
+		}
+	}
+	return values, nil
+}
+
+func readFlatConfig(r io.Reader, path, sep string) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key%svalue", path, lineNo, sep)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// Strip quotes, or a trailing comment from unquoted values
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		} else if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// parseSize parses a byte count with an optional KB, MB or GB suffix
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// formatSize is the inverse of parseSize for whole units
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+}
+
+// parsePerm parses an octal permission string such as "0755"
+func parsePerm(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0777 {
+		return 0, fmt.Errorf("%o is not a permission mode", n)
+	}
+	return os.FileMode(n), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONConfigValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"port": "9000", "max_upload_size": 1024, "user_homes": true, "tls_self_signed": false}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"port":            "9000",
+		"max_upload_size": "1024",
+		"user_homes":      "true",
+		"tls_self_signed": "false",
+	}
+	for key, v := range want {
+		if values[key] != v {
+			t.Errorf("%s is %q, want %q", key, values[key], v)
+		}
+	}
+}
+
+func TestJSONConfigRejectsNested(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"port": [9000]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfigFile(path); err == nil {
+		t.Error("a list value was accepted")
+	}
+}
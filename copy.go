@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// handleAPICopy copies a file or directory tree to another location. Large
+// trees can be copied in the background and followed through /api/jobs.
+func handleAPICopy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		From       string `json:"from"`
+		To         string `json:"to"`
+		Conflict   string `json:"conflict"`
+		Background bool   `json:"background"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.Conflict == "" {
+		reqBody.Conflict = conflictFail
+	}
+	if reqBody.Conflict != conflictFail && reqBody.Conflict != conflictOverwrite && reqBody.Conflict != conflictAutorename {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or autorename", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fromPath, err := resolvePath(r, reqBody.From)
+	if err != nil || reqBody.From == "" {
+		sendJSONError(w, "Invalid source path", http.StatusBadRequest)
+		return
+	}
+	toPath, err := resolvePath(r, reqBody.To)
+	if err != nil || reqBody.To == "" || isRoot(r, toPath) {
+		sendJSONError(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	if isWithin(toPath, fromPath) {
+		sendJSONError(w, "Cannot copy a directory into itself", http.StatusBadRequest)
+		return
+	}
+	if isWithin(fromPath, toPath) {
+		sendJSONError(w, "Cannot copy a path onto a directory containing it", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeRead, fromPath) || !checkScope(w, r, scopeWrite, toPath) ||
+		!checkAccess(w, r, permRead, fromPath) || !checkAccess(w, r, permWrite, toPath) {
+		return
+	}
+
+	if _, err := storage.Stat(fromPath); err != nil {
+		if os.IsNotExist(err) {
+			sendJSONError(w, "Source not found", http.StatusNotFound)
+			return
+		}
+		sendJSONError(w, "Failed to access source", http.StatusInternalServerError)
+		return
+	}
+
+	if !checkOverwrite(w, r, reqBody.Conflict, toPath) {
+		return
+	}
+	toPath, status, err := resolveConflict(toPath, reqBody.Conflict)
+	if err != nil {
+		sendJSONError(w, err.Error(), status)
+		return
+	}
+
+	// The copy is made under a temp name and only takes the place of the
+	// destination once it is complete, so a failed or cancelled copy leaves
+	// the destination as it was
+	staging := filepath.Join(filepath.Dir(toPath), tempPrefix+randomID())
+	overwrite := reqBody.Conflict == conflictOverwrite
+	filter := readFilter(r)
+	copyFn := func(ctx context.Context, j *Job) error {
+		if err := copyTree(ctx, j, fromPath, staging, filter); err != nil {
+			return err
+		}
+		return placeCopy(r, staging, toPath, overwrite)
+	}
+
+	if reqBody.Background {
+		j := startJob(r, "copy", apiPath(r, fromPath), apiPath(r, toPath), copyFn)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Copy started",
+			"job":     j.Status(),
+		})
+		return
+	}
+
+	// Copy while the client waits, stopping if it goes away
+	j := newJob(r, "copy", apiPath(r, fromPath), apiPath(r, toPath))
+	if err := j.run(r.Context(), copyFn); err != nil {
+		sendJSONError(w, "Failed to copy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"message":      fmt.Sprintf("Copied '%s' to '%s'", j.Source, j.Target),
+		"path":         j.Target,
+		"bytes_copied": j.bytesDone.Load(),
+		"files_copied": j.filesDone.Load(),
+	})
+}
+
+// placeCopy renames a finished copy to its destination. Without overwrite a
+// destination that appeared while copying is left alone and the copy is
+// dropped.
+func placeCopy(r *http.Request, staging, target string, overwrite bool) error {
+	var err error
+	if overwrite {
+		err = replacePath(r, staging, target)
+	} else if _, statErr := storage.Stat(target); statErr == nil {
+		err = errors.New("destination already exists")
+	} else {
+		err = storage.Rename(staging, target)
+	}
+	if err != nil {
+		storage.Remove(staging)
+		dropSidecar(staging)
+		return err
+	}
+	moveSidecar(staging, target)
+	return nil
+}
+
+// copyTree copies src to dst, recursing into directories and preserving
+// modification times. Anything other than regular files and directories is
+// skipped, as is anything filter rejects if set. A partially copied
+// destination is removed on failure.
+func copyTree(ctx context.Context, j *Job, src, dst string, filter func(fullPath string) bool) (err error) {
+	// Total size first so progress can be reported
+	walkStorage(src, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			j.bytesTotal.Add(info.Size())
+		}
+		return nil
+	})
+
+	defer func() {
+		if err != nil {
+			storage.Remove(dst)
+			dropSidecar(dst)
+		}
+	}()
+
+	// Directory times are set last, deepest first, since copying into a
+	// directory updates its modification time
+	type dirTime struct {
+		path string
+		info fs.FileInfo
+	}
+	var dirs []dirTime
+
+	err = walkStorage(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case isInternalName(info.Name()) || (filter != nil && !filter(path)):
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		case info.IsDir():
+			if err := storage.Mkdir(target, config.DirPerm); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{target, info})
+		case info.Mode().IsRegular():
+			if err := copyFile(ctx, j, path, target, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		storage.Chtimes(dirs[i].path, dirs[i].info.ModTime())
+	}
+	return nil
+}
+
+// copyFile copies a single regular file and its modification time
+func copyFile(ctx context.Context, j *Job, src, dst string, info fs.FileInfo) error {
+	in, err := storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := storage.Mkdir(filepath.Dir(dst), config.DirPerm); err != nil {
+		return err
+	}
+
+	// Content that is stored as a blob only needs another reference
+	if linkBlob(src, dst, info) {
+		j.bytesDone.Add(info.Size())
+		j.filesDone.Add(1)
+		return nil
+	}
+
+	out, err := storage.Create(filepath.Dir(dst), config.FilePerm)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	if _, err := io.Copy(&progressWriter{ctx: ctx, w: out, job: j}, in); err != nil {
+		return err
+	}
+	if err := out.Commit(dst, true); err != nil {
+		return err
+	}
+
+	j.filesDone.Add(1)
+	return storage.Chtimes(dst, info.ModTime())
+}
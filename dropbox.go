@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// handleDropBox serves an upload share. GET shows a minimal upload form and
+// POST takes a multipart form of files, which are stored directly in the
+// shared folder under names that never replace an existing file. Nothing in
+// the folder is ever listed or downloadable through the link. Uploads are
+// only taken while the owner may still write to the folder.
+func handleDropBox(w http.ResponseWriter, r *http.Request, sh *Share, snapshot *Share, root string) {
+	canWrite := snapshot.ownerFilter(permWrite)
+	if canWrite != nil && !canWrite(root) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data := map[string]interface{}{
+			"Upload":    true,
+			"Name":      filepath.Base(root),
+			"FileTypes": strings.Join(snapshot.FileTypes, ", "),
+		}
+		if snapshot.MaxFileSize > 0 {
+			data["MaxFileSize"] = formatSize(snapshot.MaxFileSize)
+		}
+		renderShare(w, data)
+
+	case http.MethodPost:
+		w.Header().Set("Content-Type", "application/json")
+		if !limitUploadBody(w, r) {
+			return
+		}
+
+		dirPath := "/"
+		receiveMultipart(w, r, &dirPath, nil, func(filePath string, part *multipart.Part) (string, int64, error) {
+			// Folders sent by the uploader are flattened
+			name := path.Base(filePath)
+			if isInternalName(name) {
+				return "", 0, &uploadError{"Invalid file name", http.StatusBadRequest}
+			}
+			if !snapshot.acceptsType(name) {
+				return "", 0, &uploadError{"File type not allowed", http.StatusUnsupportedMediaType}
+			}
+
+			target := filepath.Join(root, name)
+			if canWrite != nil && !canWrite(target) {
+				return "", 0, &uploadError{"Permission denied", http.StatusForbidden}
+			}
+
+			var src io.Reader = part
+			if snapshot.MaxFileSize > 0 {
+				src = &limitedReader{r: part, max: snapshot.MaxFileSize}
+			}
+			saved, n, err := storeFile(r, target, src, conflictRename, nil)
+			if err != nil {
+				return "", n, err
+			}
+
+			countShareUpload(sh)
+			log.Printf("Share %s (%s): received %s, %d bytes, from %s", sh.ID, snapshot.Path, filepath.Base(saved), n, r.RemoteAddr)
+			return "/" + filepath.Base(saved), n, nil
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// acceptsType reports whether a file name has one of the extensions an
+// upload share is limited to. Without a limit every name is accepted.
+func (sh *Share) acceptsType(name string) bool {
+	if len(sh.FileTypes) == 0 {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range sh.FileTypes {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFileTypes normalizes a list of allowed extensions to lower case with
+// a leading dot, so "PDF" and ".pdf" mean the same
+func parseFileTypes(types []string) ([]string, error) {
+	var normalized []string
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !strings.HasPrefix(t, ".") {
+			t = "." + t
+		}
+		if t == "." || strings.ContainsAny(t, `/\`) {
+			return nil, errors.New("Invalid file type: " + t)
+		}
+		normalized = append(normalized, t)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// extractFormats lists the archive suffixes /api/extract understands
+var extractFormats = []struct {
+	suffix string
+	format string
+}{
+	{".tar.gz", "tar.gz"},
+	{".tgz", "tar.gz"},
+	{".tar.zst", "tar.zst"},
+	{".tzst", "tar.zst"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// errExtractLimit is returned when an archive exceeds the configured limits
+var errExtractLimit = errors.New("archive exceeds extraction limits")
+
+// errExtractDenied is returned for an entry the user may not write
+var errExtractDenied = errors.New("permission denied")
+
+// handleAPIExtract unpacks an archive already in the upload directory into a
+// target directory, optionally as a background job
+func handleAPIExtract(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		Path       string `json:"path"`
+		To         string `json:"to"`
+		Conflict   string `json:"conflict"`
+		Background bool   `json:"background"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.Conflict == "" {
+		reqBody.Conflict = conflictFail
+	}
+	if reqBody.Conflict != conflictFail && reqBody.Conflict != conflictOverwrite && reqBody.Conflict != conflictAutorename {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or autorename", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	archivePath, err := resolvePath(r, reqBody.Path)
+	if err != nil || reqBody.Path == "" {
+		sendJSONError(w, "Invalid archive path", http.StatusBadRequest)
+		return
+	}
+
+	format, base := archiveFormat(filepath.Base(archivePath))
+	if format == "" {
+		sendJSONError(w, "Archive must be a .zip, .tar, .tar.gz or .tar.zst file", http.StatusBadRequest)
+		return
+	}
+
+	info, err := storage.Stat(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendJSONError(w, "Archive not found", http.StatusNotFound)
+			return
+		}
+		sendJSONError(w, "Failed to access archive", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		sendJSONError(w, "Archive must be a file", http.StatusBadRequest)
+		return
+	}
+
+	// By default extract next to the archive, into a directory named after it
+	if reqBody.To == "" {
+		reqBody.To = path.Join(apiPath(r, filepath.Dir(archivePath)), base)
+	}
+	destPath, err := resolvePath(r, reqBody.To)
+	if err != nil {
+		sendJSONError(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeRead, archivePath) || !checkScope(w, r, scopeWrite, destPath) ||
+		!checkAccess(w, r, permRead, archivePath) || !checkAccess(w, r, permWrite, destPath) {
+		return
+	}
+
+	// An existing destination is merged into with overwrite, otherwise the
+	// usual conflict policy applies
+	created := true
+	if info, err := storage.Stat(destPath); err == nil {
+		switch {
+		case !info.IsDir():
+			sendJSONError(w, "Destination is not a directory", http.StatusConflict)
+			return
+		case reqBody.Conflict == conflictOverwrite:
+			// Entries may replace anything below it
+			if !checkOverwrite(w, r, reqBody.Conflict, destPath) {
+				return
+			}
+			created = false
+		case reqBody.Conflict == conflictAutorename:
+			if destPath, err = uniquePath(destPath); err != nil {
+				sendJSONError(w, "Failed to find a free name", http.StatusConflict)
+				return
+			}
+		default:
+			sendJSONError(w, "Destination already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	canWrite := accessFilter(r, permWrite)
+	extractFn := func(ctx context.Context, j *Job) (err error) {
+		defer func() {
+			if err != nil && created {
+				storage.Remove(destPath)
+			}
+		}()
+		return extractArchive(ctx, r, j, archivePath, format, destPath, canWrite)
+	}
+
+	if reqBody.Background {
+		j := startJob(r, "extract", apiPath(r, archivePath), apiPath(r, destPath), extractFn)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": "Extraction started",
+			"job":     j.Status(),
+		})
+		return
+	}
+
+	// Extract while the client waits, stopping if it goes away
+	j := newJob(r, "extract", apiPath(r, archivePath), apiPath(r, destPath))
+	if err := j.run(r.Context(), extractFn); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errExtractLimit) {
+			status = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, errExtractDenied) {
+			status = http.StatusForbidden
+		}
+		sendJSONError(w, "Failed to extract: "+err.Error(), status)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         true,
+		"message":         fmt.Sprintf("Extracted '%s' to '%s'", j.Source, j.Target),
+		"path":            j.Target,
+		"files_extracted": j.filesDone.Load(),
+	})
+}
+
+// archiveFormat returns the format of an archive and its name without the
+// archive suffix, or an empty format if the name is not a known archive
+func archiveFormat(name string) (format, base string) {
+	lower := strings.ToLower(name)
+	for _, f := range extractFormats {
+		if strings.HasSuffix(lower, f.suffix) {
+			return f.format, name[:len(name)-len(f.suffix)]
+		}
+	}
+	return "", name
+}
+
+// extractor writes archive entries below dest while enforcing the size and
+// entry count limits
+type extractor struct {
+	ctx     context.Context
+	r       *http.Request // the request that started the extraction
+	job     *Job
+	dest    string
+	entries int64
+	written int64
+	dirs    map[string]time.Time
+	allowed func(fullPath string) bool // where entries may be written, nil for anywhere
+
+	// countWritten reports progress as extracted bytes rather than archive
+	// bytes read, for formats whose total size is known up front
+	countWritten bool
+}
+
+// extractArchive unpacks an archive into dest, failing on the first entry
+// that allowed rejects if set. Entries replace existing files the way
+// replacePath does, so the old content is kept as a version or trashed.
+func extractArchive(ctx context.Context, r *http.Request, j *Job, archivePath, format, dest string, allowed func(fullPath string) bool) error {
+	if err := storage.Mkdir(dest, config.DirPerm); err != nil {
+		return err
+	}
+
+	x := &extractor{ctx: ctx, r: r, job: j, dest: dest, dirs: make(map[string]time.Time), allowed: allowed}
+
+	var err error
+	if format == "zip" {
+		err = x.extractZip(archivePath)
+	} else {
+		err = x.extractTar(archivePath, format)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Directory times last, since writing into a directory changes its time
+	for dir, mtime := range x.dirs {
+		storage.Chtimes(dir, mtime)
+	}
+	return nil
+}
+
+func (x *extractor) extractZip(archivePath string) error {
+	file, err := storage.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := storage.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	// The central directory lets the limits be checked before writing anything
+	var total uint64
+	for _, f := range zr.File {
+		total += f.UncompressedSize64
+	}
+	if config.ExtractMaxEntries > 0 && int64(len(zr.File)) > config.ExtractMaxEntries {
+		return fmt.Errorf("%w: %d entries", errExtractLimit, len(zr.File))
+	}
+	if config.ExtractMaxSize > 0 && total > uint64(config.ExtractMaxSize) {
+		return fmt.Errorf("%w: %d bytes", errExtractLimit, total)
+	}
+	x.job.bytesTotal.Store(int64(total))
+	x.countWritten = true
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if !mode.IsDir() && !mode.IsRegular() {
+			continue
+		}
+
+		var rc io.ReadCloser
+		if !mode.IsDir() {
+			if rc, err = f.Open(); err != nil {
+				return err
+			}
+		}
+		err := x.writeEntry(f.Name, mode.IsDir(), f.Modified, rc)
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractTar(archivePath, format string) error {
+	file, err := storage.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The uncompressed size of a tar is unknown up front, so progress
+	// follows how much of the archive file has been read
+	if info, err := storage.Stat(archivePath); err == nil {
+		x.job.bytesTotal.Store(info.Size())
+	}
+	var src io.Reader = &countingReader{ctx: x.ctx, r: file, job: x.job}
+
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Links and devices are skipped, they could point anywhere
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.writeEntry(header.Name, true, header.ModTime, nil)
+		case tar.TypeReg:
+			err = x.writeEntry(header.Name, false, header.ModTime, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeEntry creates one directory or file from an archive
+func (x *extractor) writeEntry(name string, isDir bool, mtime time.Time, src io.Reader) error {
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+
+	x.entries++
+	if config.ExtractMaxEntries > 0 && x.entries > config.ExtractMaxEntries {
+		return fmt.Errorf("%w: more than %d entries", errExtractLimit, config.ExtractMaxEntries)
+	}
+
+	// Guard against zip-slip: the entry must stay inside the destination,
+	// and so inside the upload directory
+	target, err := rootView.resolve(path.Join(rootView.apiPath(x.dest), filepath.ToSlash(name)))
+	if err != nil || !isWithin(target, x.dest) {
+		return fmt.Errorf("entry %q escapes the destination", name)
+	}
+	if x.allowed != nil && !x.allowed(target) {
+		return fmt.Errorf("%w: entry %q", errExtractDenied, name)
+	}
+
+	if isDir {
+		if err := storage.Mkdir(target, config.DirPerm); err != nil {
+			return err
+		}
+		if !mtime.IsZero() {
+			x.dirs[target] = mtime
+		}
+		return nil
+	}
+
+	if err := storage.Mkdir(filepath.Dir(target), config.DirPerm); err != nil {
+		return err
+	}
+	if info, err := storage.Stat(target); err == nil && info.IsDir() {
+		return fmt.Errorf("entry %q conflicts with a directory", name)
+	}
+
+	// Never write more than the remaining allowance, whatever the headers say
+	limited := src
+	if config.ExtractMaxSize > 0 {
+		limited = io.LimitReader(src, config.ExtractMaxSize-x.written+1)
+	}
+
+	pending, err := storage.Create(filepath.Dir(target), config.FilePerm)
+	if err != nil {
+		return err
+	}
+	defer pending.Abort()
+	var dst io.Writer = pending
+	if x.countWritten {
+		dst = &progressWriter{ctx: x.ctx, w: pending, job: x.job}
+	}
+
+	n, err := io.Copy(dst, limited)
+	x.written += n
+	if err == nil && config.ExtractMaxSize > 0 && x.written > config.ExtractMaxSize {
+		err = fmt.Errorf("%w: more than %d bytes", errExtractLimit, config.ExtractMaxSize)
+	}
+	if err == nil {
+		err = x.place(pending, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	x.job.filesDone.Add(1)
+	if mtime.IsZero() {
+		return nil
+	}
+	return storage.Chtimes(target, mtime)
+}
+
+// place commits an extracted file to target. An existing file is replaced
+// through a temp name with replacePath, which keeps its content as a version
+// or moves it to the trash.
+func (x *extractor) place(pending PendingFile, target string) error {
+	err := pending.Commit(target, false)
+	if !os.IsExist(err) {
+		return err
+	}
+
+	staging := filepath.Join(filepath.Dir(target), tempPrefix+randomID())
+	if err := pending.Commit(staging, false); err != nil {
+		return err
+	}
+	if err := replacePath(x.r, staging, target); err != nil {
+		storage.Remove(staging)
+		return err
+	}
+	pruneVersions(target)
+	return nil
+}
+
+// countingReader adds the bytes read to a job's progress and stops once its
+// context is cancelled
+type countingReader struct {
+	ctx context.Context
+	r   io.Reader
+	job *Job
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(b)
+	c.job.bytesDone.Add(int64(n))
+	return n, err
+}
@@ -1,3 +1,11 @@
 module file_server
 
 go 1.24.1
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.45.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.12 // indirect
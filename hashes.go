@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Content hashes the server can compute. SHA-256 is always computed, the
+// others when hash-algorithms asks for them or a client sends one to check.
+const (
+	hashSHA256 = "sha256"
+	hashMD5    = "md5"
+	hashBLAKE3 = "blake3"
+)
+
+// hashHeaders are the request headers carrying expected checksums
+var hashHeaders = map[string]string{
+	hashSHA256: "X-Checksum-SHA256",
+	hashMD5:    "X-Checksum-MD5",
+	hashBLAKE3: "X-Checksum-BLAKE3",
+}
+
+// hashLabels are the names of the algorithms in messages
+var hashLabels = map[string]string{
+	hashSHA256: "SHA-256",
+	hashMD5:    "MD5",
+	hashBLAKE3: "BLAKE3",
+}
+
+// digestNames are the algorithm names used in Digest and Repr-Digest
+var digestNames = map[string]string{
+	hashSHA256: "sha-256",
+	hashMD5:    "md5",
+}
+
+// newHash returns a fresh hash for an algorithm, or nil for unknown ones
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case hashSHA256:
+		return sha256.New()
+	case hashMD5:
+		return md5.New()
+	case hashBLAKE3:
+		return blake3.New(32, nil)
+	}
+	return nil
+}
+
+// checksums maps algorithm names to lowercase hex digests
+type checksums map[string]string
+
+// hasher computes several hashes of the same stream at once
+type hasher map[string]hash.Hash
+
+// newHasher hashes with SHA-256, the configured algorithms and any
+// algorithm an expected checksum is given for
+func newHasher(expect checksums) hasher {
+	h := hasher{hashSHA256: sha256.New()}
+	for _, algo := range config.HashAlgorithms {
+		h[algo] = newHash(algo)
+	}
+	for algo := range expect {
+		if h[algo] == nil {
+			h[algo] = newHash(algo)
+		}
+	}
+	return h
+}
+
+func (h hasher) Write(p []byte) (int, error) {
+	for _, each := range h {
+		each.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the digests of everything written so far
+func (h hasher) sums() checksums {
+	sums := checksums{}
+	for algo, each := range h {
+		sums[algo] = hex.EncodeToString(each.Sum(nil))
+	}
+	return sums
+}
+
+// verify compares computed digests with expected ones, returning a 422
+// upload error naming the first that differs
+func (c checksums) verify(expect checksums) error {
+	algos := make([]string, 0, len(expect))
+	for algo := range expect {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	for _, algo := range algos {
+		if c[algo] != expect[algo] {
+			return &uploadError{hashLabels[algo] + " checksum mismatch", http.StatusUnprocessableEntity}
+		}
+	}
+	return nil
+}
+
+// parseChecksum normalizes an expected digest given in hex or base64
+func parseChecksum(algo, value string) (string, error) {
+	size := newHash(algo).Size()
+	value = strings.TrimSpace(value)
+	if b, err := hex.DecodeString(value); err == nil && len(b) == size {
+		return hex.EncodeToString(b), nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil && len(b) == size {
+		return hex.EncodeToString(b), nil
+	}
+	return "", &uploadError{"Invalid " + hashLabels[algo] + " checksum", http.StatusBadRequest}
+}
+
+// expectedChecksums reads the X-Checksum-* headers of a request
+func expectedChecksums(r *http.Request) (checksums, error) {
+	expect := checksums{}
+	for algo, header := range hashHeaders {
+		if value := r.Header.Get(header); value != "" {
+			sum, err := parseChecksum(algo, value)
+			if err != nil {
+				return nil, err
+			}
+			expect[algo] = sum
+		}
+	}
+	return expect, nil
+}
+
+// hashFile computes the digests of a stored file's content
+func hashFile(fullPath string, expect checksums) (checksums, error) {
+	f, err := storage.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashReader(f, expect)
+}
+
+// hashReader computes the digests of everything read from src
+func hashReader(src io.Reader, expect checksums) (checksums, error) {
+	h := newHasher(expect)
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, err
+	}
+	return h.sums(), nil
+}
+
+// setFileDigests advertises the hashes of a file, if they are known
+func setFileDigests(w http.ResponseWriter, fullPath string) {
+	if info, err := storage.Stat(fullPath); err == nil {
+		if meta := readMeta(fullPath, info); meta != nil {
+			setDigestHeaders(w, meta.Hashes)
+		}
+	}
+}
+
+// setDigestHeaders advertises the known hashes of a file in the Digest
+// (RFC 3230) and Repr-Digest (RFC 9530) headers
+func setDigestHeaders(w http.ResponseWriter, sums checksums) {
+	var digest, repr []string
+	for _, algo := range []string{hashSHA256, hashMD5} {
+		sum, err := hex.DecodeString(sums[algo])
+		if err != nil || len(sum) == 0 {
+			continue
+		}
+		encoded := base64.StdEncoding.EncodeToString(sum)
+		digest = append(digest, digestNames[algo]+"="+encoded)
+		repr = append(repr, digestNames[algo]+"=:"+encoded+":")
+	}
+	if len(digest) > 0 {
+		w.Header().Set("Digest", strings.Join(digest, ","))
+		w.Header().Set("Repr-Digest", strings.Join(repr, ", "))
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job states
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobRetention is how long finished jobs stay queryable
+const jobRetention = time.Hour
+
+// Job tracks a long-running operation such as a copy of a large tree
+type Job struct {
+	ID     string
+	Kind   string
+	Source string
+	Target string
+	User   string // who started the job, if anyone is logged in
+	Token  string // ID of the API token it was started with, if any
+
+	bytesDone  atomic.Int64
+	bytesTotal atomic.Int64
+	filesDone  atomic.Int64
+
+	mu       sync.Mutex
+	status   string
+	err      string
+	started  time.Time
+	finished time.Time
+	cancel   context.CancelFunc
+}
+
+// JobStatus is the JSON representation of a job
+type JobStatus struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Status     string `json:"status"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	User       string `json:"user,omitempty"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total"`
+	FilesDone  int64  `json:"files_done"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*Job)
+)
+
+// newJob creates a job for a request that is not yet registered or running
+func newJob(r *http.Request, kind, source, target string) *Job {
+	j := &Job{
+		ID:     randomID(),
+		Kind:   kind,
+		Source: source,
+		Target: target,
+		status: jobRunning,
+	}
+	if user := currentUser(r); user != nil {
+		j.User = user.Name
+	}
+	if t := currentToken(r); t != nil {
+		j.Token = t.ID
+	}
+	return j
+}
+
+// visibleTo reports whether a request may see and cancel the job. Jobs
+// belong to the user that started them, and those started with a token only
+// to that token. Admins see every job, as does everyone without accounts.
+func (j *Job) visibleTo(r *http.Request) bool {
+	user := currentUser(r)
+	if user == nil || user.Admin {
+		return true
+	}
+	if j.User != user.Name {
+		return false
+	}
+	t := currentToken(r)
+	return t == nil || j.Token == t.ID
+}
+
+// run executes fn as the body of the job and records its outcome
+func (j *Job) run(ctx context.Context, fn func(ctx context.Context, j *Job) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	j.mu.Lock()
+	if j.started.IsZero() {
+		j.started = time.Now()
+	}
+	if j.cancel == nil {
+		j.cancel = cancel
+	}
+	j.mu.Unlock()
+
+	err := fn(ctx, j)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.status = jobCompleted
+	case errors.Is(err, context.Canceled):
+		j.status = jobCancelled
+	default:
+		j.status = jobFailed
+		j.err = err.Error()
+	}
+	return err
+}
+
+// startJob registers a job for a request and runs fn in the background
+func startJob(r *http.Request, kind, source, target string, fn func(ctx context.Context, j *Job) error) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := newJob(r, kind, source, target)
+	j.started = time.Now()
+	j.cancel = cancel
+
+	jobsMu.Lock()
+	pruneJobs()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		j.run(ctx, fn)
+	}()
+	return j
+}
+
+// Cancel stops a running job
+func (j *Job) Cancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancel != nil && j.status == jobRunning {
+		j.cancel()
+	}
+}
+
+// runningJobs returns how many registered jobs have not finished yet
+func runningJobs() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	n := 0
+	for _, j := range jobs {
+		j.mu.Lock()
+		if j.status == jobRunning {
+			n++
+		}
+		j.mu.Unlock()
+	}
+	return n
+}
+
+// cancelAllJobs stops every running job
+func cancelAllJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		j.Cancel()
+	}
+}
+
+// Status returns a snapshot of the job for the API
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := JobStatus{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Status:     j.status,
+		Source:     j.Source,
+		Target:     j.Target,
+		User:       j.User,
+		BytesDone:  j.bytesDone.Load(),
+		BytesTotal: j.bytesTotal.Load(),
+		FilesDone:  j.filesDone.Load(),
+		Error:      j.err,
+		StartedAt:  j.started.Format(config.TimeFormat),
+	}
+	if !j.finished.IsZero() {
+		s.FinishedAt = j.finished.Format(config.TimeFormat)
+	}
+	return s
+}
+
+func (j *Job) startedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.started
+}
+
+// pruneJobs forgets jobs that finished more than jobRetention ago.
+// jobsMu must be held.
+func pruneJobs() {
+	for id, j := range jobs {
+		j.mu.Lock()
+		expired := !j.finished.IsZero() && time.Since(j.finished) > jobRetention
+		j.mu.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+}
+
+// handleAPIJobs reports on or cancels background jobs
+func handleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.URL.Query().Get("id")
+
+	jobsMu.Lock()
+	pruneJobs()
+	j := jobs[id]
+	if j != nil && !j.visibleTo(r) {
+		j = nil
+	}
+	var all []*Job
+	if id == "" {
+		for _, j := range jobs {
+			if j.visibleTo(r) {
+				all = append(all, j)
+			}
+		}
+	}
+	jobsMu.Unlock()
+
+	if id != "" && j == nil {
+		sendJSONError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
+		if j != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"job":     j.Status(),
+			})
+			return
+		}
+
+		// Newest first
+		sort.Slice(all, func(a, b int) bool { return all[a].startedAt().After(all[b].startedAt()) })
+		list := []JobStatus{}
+		for _, j := range all {
+			list = append(list, j.Status())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"jobs":    list,
+		})
+
+	case http.MethodDelete:
+		if j == nil {
+			sendJSONError(w, "Job id is required", http.StatusBadRequest)
+			return
+		}
+		if !checkScope(w, r, scopeWrite) {
+			return
+		}
+		j.Cancel()
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: "Job cancelled",
+		})
+
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// progressWriter counts bytes written for a job and stops once its context is
+// cancelled
+type progressWriter struct {
+	ctx context.Context
+	w   io.Writer
+	job *Job
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	p.job.bytesDone.Add(int64(n))
+	return n, err
+}
+
+// randomID returns a random hex identifier
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
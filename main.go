@@ -4,27 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-)
-
-const (
-	// Configuration constants
-	uploadPath = "./uploads"  // Base directory for all uploads
-	port       = 8080         // Server port
+	"time"
 )
 
 // File represents a file or directory in the system
 type File struct {
-	Name      string `json:"name"`
-	Path      string `json:"path"`
-	IsDir     bool   `json:"is_dir"`
-	Size      int64  `json:"size,omitempty"`
-	UpdatedAt string `json:"updated_at,omitempty"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size,omitempty"`
+	UpdatedAt string    `json:"updated_at,omitempty"`
+	Hashes    checksums `json:"hashes,omitempty"`
 }
 
 // ResponseMessage represents API response messages
@@ -34,23 +29,156 @@ type ResponseMessage struct {
 }
 
 func main() {
+	// Load configuration from flags, environment and config file
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config = cfg
+
+	// Open the storage holding the files
+	storage, err = storageBackends[config.Storage](config)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", config.Storage, err)
+	}
+
+	// Subcommands run instead of the server
+	if len(args) > 0 {
+		switch args[0] {
+		case "user":
+			err = runUserCommand(args[1:])
+		case "keys":
+			err = runKeysCommand(args[1:])
+		case "blobs":
+			err = runBlobsCommand(args[1:])
+		default:
+			log.Fatalf("Unknown command %q", args[0])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Load user accounts, without them everyone has full access
+	if config.UsersFile == "" {
+		log.Printf("WARNING: no users-file configured, authentication is disabled")
+	} else {
+		store, err := loadUserStore(config.UsersFile)
+		if err != nil {
+			log.Fatalf("Failed to load users: %v", err)
+		}
+		users = store
+	}
+	if config.TokensFile != "" {
+		store, err := loadTokenStore(config.TokensFile)
+		if err != nil {
+			log.Fatalf("Failed to load API tokens: %v", err)
+		}
+		tokens = store
+	}
+	if config.SharesFile != "" {
+		store, err := loadShareStore(config.SharesFile)
+		if err != nil {
+			log.Fatalf("Failed to load shares: %v", err)
+		}
+		shares = store
+		go func() {
+			for {
+				time.Sleep(shareFlushInterval)
+				shares.flush()
+			}
+		}()
+	}
+	if config.SigningKeysFile != "" {
+		store, err := loadSigningKeys(config.SigningKeysFile)
+		if err != nil {
+			log.Fatalf("Failed to load signing keys: %v", err)
+		}
+		// The first start creates a key, later ones come from "keys rotate"
+		if key, _ := store.current(); key == nil {
+			store.mu.Lock()
+			key, err = store.rotate()
+			store.mu.Unlock()
+			if err != nil {
+				log.Fatalf("Failed to create signing key: %v", err)
+			}
+			log.Printf("Created signing key %s", key.ID)
+		}
+		signingKeys = store
+	}
+	if config.ACLFile != "" {
+		store, err := loadACL(config.ACLFile)
+		if err != nil {
+			log.Fatalf("Failed to load ACL: %v", err)
+		}
+		acl = store
+	}
+
 	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadPath, 0755); err != nil {
+	if err := storage.Mkdir(config.UploadPath, config.DirPerm); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
+	// Clean up after uploads interrupted by a previous run
+	sweepTempFiles()
+
+	// Expire abandoned resumable uploads, old items in the trash and old
+	// versions, then collect the blobs nothing refers to any more
+	go func() {
+		for {
+			sweepTusUploads()
+			purgeTrash()
+			pruneAllVersions()
+			if config.ContentAddressed {
+				collectBlobs()
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+
 	// Set up routes
 	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/api/files", handleAPIFiles)
-	http.HandleFunc("/api/upload", handleAPIUpload)
-	http.HandleFunc("/api/mkdir", handleAPIMkdir)
-	http.HandleFunc("/download/", handleDownload)
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/api/files", requireAuth(handleAPIFiles))
+	http.HandleFunc("/api/upload", requireAuth(handleAPIUpload))
+	http.HandleFunc("/api/upload/", requireAuth(handleAPIUpload))
+	http.HandleFunc("/api/exists", requireAuth(handleAPIExists))
+	http.HandleFunc(tusBasePath, requireAuth(handleTus))
+	http.HandleFunc("/api/mkdir", requireAuth(handleAPIMkdir))
+	http.HandleFunc("/api/move", requireAuth(handleAPIMove))
+	http.HandleFunc("/api/copy", requireAuth(handleAPICopy))
+	http.HandleFunc("/api/extract", requireAuth(handleAPIExtract))
+	http.HandleFunc("/api/jobs", requireAuth(handleAPIJobs))
+	http.HandleFunc("/api/trash", requireAuth(handleAPITrash))
+	http.HandleFunc("/api/versions", requireAuth(handleAPIVersions))
+	http.HandleFunc("/api/storage", requireAuth(handleAPIStorage))
+	http.HandleFunc("/api/tokens", requireAuth(handleAPITokens))
+	http.HandleFunc("/api/shares", requireAuth(handleAPIShares))
+	http.HandleFunc("/api/sign", requireAuth(handleAPISign))
+	http.HandleFunc("/api/", requireAuth(http.NotFound))
+	http.HandleFunc("/download/", requireAuth(handleDownload))
+	http.HandleFunc(shareBasePath, handleShare)
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
 
 	// Start the server
-	log.Printf("Server starting on port %d...", port)
-	log.Printf("Web interface: http://localhost:%d", port)
-	log.Printf("Upload directory: %s", uploadPath)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("Server starting on port %d...", config.Port)
+	log.Printf("Web interface: %s://localhost:%d", scheme, config.Port)
+	log.Printf("Upload directory: %s", config.UploadPath)
+	for _, s := range settings {
+		log.Printf("Config %s: %s", s.name, s.get(config))
+	}
+
+	serve(tlsConfig)
 }
 
 // handleIndex serves the main web interface
@@ -60,65 +188,131 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data := map[string]interface{}{
+		"Title":    "File Server",
+		"Shares":   shares != nil,
+		"Trash":    config.TrashRetention > 0,
+		"Versions": versionsEnabled(),
+	}
+
+	// Without a session the page only shows the login form
+	if users != nil {
+		_, s := sessionFromRequest(r)
+
+		// A client certificate logs the browser in without the form
+		if s == nil || users.get(s.user) == nil {
+			if u, _ := certUser(r); u != nil {
+				s = startSession(w, r, u)
+				log.Printf("User %s logged in with a client certificate from %s", u.Name, r.RemoteAddr)
+			}
+		}
+
+		if s != nil && users.get(s.user) != nil {
+			data["User"] = s.user
+			data["CSRFToken"] = s.csrfToken
+			data["Tokens"] = tokens != nil
+			data["Home"] = userView(users.get(s.user)) != rootView
+		} else {
+			data["LoginRequired"] = true
+			data["LoginError"] = r.URL.Query().Get("login_error") != ""
+		}
+	}
+
 	// Parse the HTML template
 	tmpl := template.Must(template.New("index").Parse(indexHTML))
-	tmpl.Execute(w, map[string]interface{}{
-		"Title": "File Server",
-	})
+	tmpl.Execute(w, data)
 }
 
-// handleAPIFiles lists files in the given directory
+// handleAPIFiles lists or deletes files depending on the request method
 func handleAPIFiles(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	switch r.Method {
+	case http.MethodGet:
+		handleListFiles(w, r)
+	case http.MethodDelete:
+		handleDeleteFile(w, r)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListFiles lists files in the given directory
+func handleListFiles(w http.ResponseWriter, r *http.Request) {
 	dirPath := r.URL.Query().Get("path")
 	if dirPath == "" {
 		dirPath = "/"
 	}
 
 	// Make sure we're not accessing outside the upload directory
-	fullPath := filepath.Join(uploadPath, filepath.Clean(dirPath))
-	relPath, err := filepath.Rel(uploadPath, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") {
+	fullPath, err := resolvePath(r, dirPath)
+	if err != nil {
 		sendJSONError(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
+	if !checkScope(w, r, scopeRead, fullPath) {
+		return
+	}
+
+	// A directory leading to something the user may access can be browsed
+	// even without list permission, showing only the way there
+	user := currentUser(r)
+	if !acl.visible(user, fullPath) {
+		sendJSONError(w, "Permission denied", http.StatusForbidden)
+		return
+	}
 
 	// Initialize an empty file list
 	fileList := []File{}
 
-	// Read directory contents
-	files, err := os.ReadDir(fullPath)
-	if err != nil {
-		// If directory doesn't exist yet, just return an empty list
-		if os.IsNotExist(err) {
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"success": true,
-				"path":    dirPath,
-				"files":   fileList,
-			})
-			return
-		}
-		
+	// Read directory contents. A directory that doesn't exist yet is
+	// listed as empty.
+	files, err := storage.List(fullPath)
+	if err != nil && !os.IsNotExist(err) {
 		sendJSONError(w, "Failed to read directory", http.StatusInternalServerError)
 		return
 	}
 
-	for _, f := range files {
-		info, err := f.Info()
-		if err != nil {
+	// Folders mounted into the user's view appear as directories
+	mounts := requestView(r).mountsIn(dirPath)
+	for name, m := range mounts {
+		info, err := storage.Stat(m.dir)
+		if err != nil || !acl.visible(user, m.dir) {
 			continue
 		}
-
 		fileList = append(fileList, File{
-			Name:      f.Name(),
-			Path:      filepath.Join(dirPath, f.Name()),
-			IsDir:     f.IsDir(),
-			Size:      info.Size(),
-			UpdatedAt: info.ModTime().Format("2006-01-02 15:04:05"),
+			Name:      name,
+			Path:      m.path,
+			IsDir:     true,
+			UpdatedAt: info.ModTime().Format(config.TimeFormat),
 		})
 	}
 
+	for _, info := range files {
+		// Hide in-progress uploads and other server data, whatever the user
+		// may not see and anything a mount point covers
+		if isInternalName(info.Name()) || !acl.visible(user, filepath.Join(fullPath, info.Name())) {
+			continue
+		}
+		if _, ok := mounts[info.Name()]; ok {
+			continue
+		}
+
+		file := File{
+			Name:      info.Name(),
+			Path:      filepath.Join(dirPath, info.Name()),
+			IsDir:     info.IsDir(),
+			Size:      info.Size(),
+			UpdatedAt: info.ModTime().Format(config.TimeFormat),
+		}
+		if info.Mode().IsRegular() {
+			if meta := readMeta(filepath.Join(fullPath, info.Name()), info); meta != nil {
+				file.Hashes = meta.Hashes
+			}
+		}
+		fileList = append(fileList, file)
+	}
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"path":    dirPath,
@@ -126,60 +320,72 @@ func handleAPIFiles(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleAPIUpload handles file uploads
-func handleAPIUpload(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// handleDeleteFile moves a file to the trash, or a directory if it is empty
+// or the recursive flag is set. With the permanent flag, or when the trash
+// is disabled, it is removed right away.
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	filePath := r.URL.Query().Get("path")
+	recursive := r.URL.Query().Get("recursive") == "true"
+	permanent := r.URL.Query().Get("permanent") == "true" || config.TrashRetention <= 0
 
-	if r.Method != http.MethodPost {
-		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, filePath)
+	if err != nil {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-
-	// Parse the multipart form, 32 << 20 specifies a maximum upload of 32 MB
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		sendJSONError(w, "Failed to parse form", http.StatusBadRequest)
+	if isRoot(r, fullPath) {
+		sendJSONError(w, "Cannot delete the root directory", http.StatusBadRequest)
 		return
 	}
-
-	// Get the path where to save the file
-	dirPath := r.FormValue("path")
-	if dirPath == "" {
-		dirPath = "/"
-	}
-
-	// Make sure the target directory exists
-	fullDirPath := filepath.Join(uploadPath, filepath.Clean(dirPath))
-	if err := os.MkdirAll(fullDirPath, 0755); err != nil {
-		sendJSONError(w, "Failed to create directory", http.StatusInternalServerError)
+	if !checkScope(w, r, scopeDelete, fullPath) || !checkTreeAccess(w, r, permDelete, fullPath) {
 		return
 	}
 
-	// Get the uploaded file
-	file, handler, err := r.FormFile("file")
+	fileInfo, err := storage.Stat(fullPath)
 	if err != nil {
-		sendJSONError(w, "Failed to get file from form", http.StatusBadRequest)
+		if os.IsNotExist(err) {
+			sendJSONError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		sendJSONError(w, "Failed to access file", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	// Create the file on the server
-	fullPath := filepath.Join(fullDirPath, handler.Filename)
-	dst, err := os.Create(fullPath)
-	if err != nil {
-		sendJSONError(w, "Failed to create file on server", http.StatusInternalServerError)
+	if fileInfo.IsDir() && !recursive {
+		entries, err := storage.List(fullPath)
+		if err != nil {
+			sendJSONError(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+		if len(entries) > 0 {
+			sendJSONError(w, "Directory is not empty", http.StatusConflict)
+			return
+		}
+	}
+
+	if !permanent {
+		if _, err := moveToTrash(r, fullPath, fileInfo); err != nil {
+			sendJSONError(w, "Failed to move to trash", http.StatusInternalServerError)
+			return
+		}
+		logf(r, "Moved %s to the trash", rootView.apiPath(fullPath))
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: fmt.Sprintf("'%s' moved to trash", fileInfo.Name()),
+		})
 		return
 	}
-	defer dst.Close()
 
-	// Copy the file to the destination
-	if _, err := io.Copy(dst, file); err != nil {
-		sendJSONError(w, "Failed to save file", http.StatusInternalServerError)
+	if err := storage.Remove(fullPath); err != nil {
+		sendJSONError(w, "Failed to delete", http.StatusInternalServerError)
 		return
 	}
+	dropSidecar(fullPath)
 
 	json.NewEncoder(w).Encode(ResponseMessage{
 		Success: true,
-		Message: fmt.Sprintf("File uploaded successfully to %s", filepath.Join(dirPath, handler.Filename)),
+		Message: fmt.Sprintf("'%s' deleted successfully", fileInfo.Name()),
 	})
 }
 
@@ -208,14 +414,16 @@ func handleAPIMkdir(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make sure we're not accessing outside the upload directory
-	fullPath := filepath.Join(uploadPath, filepath.Clean(reqBody.Path), reqBody.Name)
-	relPath, err := filepath.Rel(uploadPath, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") {
+	fullPath, err := resolvePath(r, filepath.Join(reqBody.Path, reqBody.Name))
+	if err != nil {
 		sendJSONError(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
+	if !checkScope(w, r, scopeMkdir, fullPath) || !checkAccess(w, r, permWrite, fullPath) {
+		return
+	}
 
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
+	if err := storage.Mkdir(fullPath, config.DirPerm); err != nil {
 		sendJSONError(w, "Failed to create directory", http.StatusInternalServerError)
 		return
 	}
@@ -226,8 +434,13 @@ func handleAPIMkdir(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleDownload handles file/directory downloads
+// handleDownload handles file/directory downloads, including directories
+// as archives
 func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handleArchiveSelection(w, r)
+		return
+	}
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -240,20 +453,38 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make sure we're not accessing outside the upload directory
-	fullPath := filepath.Join(uploadPath, filepath.Clean(filePath))
-	relPath, err := filepath.Rel(uploadPath, fullPath)
-	if err != nil || strings.HasPrefix(relPath, "..") {
+	fullPath, err := resolvePath(r, filePath)
+	if err != nil {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
+	if !checkScope(w, r, scopeRead, fullPath) || !checkAccess(w, r, permRead, fullPath) {
+		return
+	}
 
 	// Check if the path exists
-	fileInfo, err := os.Stat(fullPath)
+	fileInfo, err := storage.Stat(fullPath)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
+	// Stream an archive if one was asked for
+	if format := r.URL.Query().Get("format"); format != "" {
+		name := fileInfo.Name()
+		if isRoot(r, fullPath) {
+			name = "files"
+		}
+		streamArchive(w, format, name, []archiveRoot{{fullPath, name}}, readFilter(r))
+		return
+	}
+
+	// Serve an earlier version if one was asked for
+	if id := r.URL.Query().Get("version"); id != "" && !fileInfo.IsDir() {
+		serveVersion(w, r, fullPath, id)
+		return
+	}
+
 	// If it's a directory and not requesting the root, redirect to the web interface
 	if fileInfo.IsDir() && filePath != "/" {
 		http.Redirect(w, r, "/?path="+filePath, http.StatusFound)
@@ -261,7 +492,17 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Serve the file
-	http.ServeFile(w, r, fullPath)
+	setFileDigests(w, fullPath)
+	serveStored(w, r, fullPath)
+}
+
+// internalPrefix marks files and directories the server keeps for itself
+// inside the upload directory
+const internalPrefix = ".gofs-"
+
+// isInternalName reports whether a file name is reserved for the server
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalPrefix)
 }
 
 // sendJSONError sends a JSON formatted error response
@@ -354,6 +595,13 @@ const indexHTML = `<!DOCTYPE html>
         button:hover, .button:hover {
             background: #45a049;
         }
+        button:disabled {
+            background: #a5d6a7;
+            cursor: default;
+        }
+        .file-item .select {
+            margin-right: 10px;
+        }
         input[type="file"] {
             display: none;
         }
@@ -393,12 +641,56 @@ const indexHTML = `<!DOCTYPE html>
             gap: 10px;
             margin-top: 15px;
         }
+        .modal-content.tokens {
+            width: 480px;
+        }
+        .token-item {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            padding: 6px 0;
+            border-bottom: 1px solid #eee;
+            font-size: 0.9em;
+        }
+        .token-item .meta {
+            color: #777;
+        }
+        .new-token {
+            word-break: break-all;
+            font-family: monospace;
+            margin-top: 10px;
+        }
         .cancel-btn {
             background: #f44336;
         }
         .cancel-btn:hover {
             background: #d32f2f;
         }
+        .file-item .delete-btn, .file-item .rename-btn {
+            background: none;
+            color: #f44336;
+            padding: 4px 8px;
+        }
+        .file-item .rename-btn {
+            color: #777;
+        }
+        .file-item .delete-btn:hover, .file-item .rename-btn:hover {
+            background: #fdecea;
+        }
+        .file-item .name input {
+            width: 60%;
+            padding: 4px;
+            border: 1px solid #ddd;
+            border-radius: 4px;
+        }
+        .file-list.drop-active {
+            border-color: #4CAF50;
+            background-color: #f1f8f2;
+        }
+        .file-item.drop-target {
+            background-color: #e8f5e9;
+            outline: 2px dashed #4CAF50;
+        }
         .curl-examples {
             background: #f5f5f5;
             padding: 15px;
@@ -407,6 +699,24 @@ const indexHTML = `<!DOCTYPE html>
             font-family: monospace;
             white-space: pre-wrap;
         }
+        .login {
+            max-width: 320px;
+        }
+        .login input {
+            display: block;
+            width: 100%;
+            margin-bottom: 10px;
+            padding: 8px;
+            box-sizing: border-box;
+        }
+        .login-error {
+            color: #c0392b;
+            margin-bottom: 10px;
+        }
+        .user-bar {
+            text-align: right;
+            margin-bottom: 10px;
+        }
         .spinner {
             border: 4px solid rgba(0, 0, 0, 0.1);
             width: 20px;
@@ -425,6 +735,24 @@ const indexHTML = `<!DOCTYPE html>
 </head>
 <body>
     <h1>File Server</h1>
+    {{if .LoginRequired}}
+    <div class="container login">
+        <h3>Sign in</h3>
+        {{if .LoginError}}<div class="login-error">Invalid username or password</div>{{end}}
+        <form method="POST" action="/login">
+            <input type="text" name="username" placeholder="Username" autocomplete="username" autofocus required>
+            <input type="password" name="password" placeholder="Password" autocomplete="current-password" required>
+            <button type="submit">Sign in</button>
+        </form>
+    </div>
+    {{else}}
+    {{if .User}}
+    <form class="user-bar" method="POST" action="/logout">
+        Signed in as <strong>{{.User}}</strong>
+        <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+        <button type="submit">Sign out</button>
+    </form>
+    {{end}}
     
     <div class="container">
         <div class="path-nav">
@@ -433,10 +761,16 @@ const indexHTML = `<!DOCTYPE html>
         </div>
         
         <div class="actions">
-            <button onclick="document.getElementById('fileInput').click()">Upload File</button>
-            <input type="file" id="fileInput" onchange="uploadFile()">
+            <button onclick="document.getElementById('fileInput').click()">Upload Files</button>
+            <input type="file" id="fileInput" multiple onchange="uploadFromInput(this)">
+            <button onclick="document.getElementById('folderInput').click()">Upload Folder</button>
+            <input type="file" id="folderInput" webkitdirectory onchange="uploadFromInput(this)">
             <button onclick="openMkdirModal()">Create Directory</button>
+            <button id="downloadSelected" onclick="downloadSelected()" disabled>Download Selected</button>
+            {{if .Trash}}<button onclick="openTrashModal()">Trash</button>{{end}}
+            {{if .Tokens}}<button onclick="openTokensModal()">API Tokens</button>{{end}}
             <div class="spinner" id="spinner"></div>
+            <span id="uploadProgress"></span>
         </div>
         
         <div class="file-list" id="fileList">
@@ -455,8 +789,77 @@ const indexHTML = `<!DOCTYPE html>
             </div>
         </div>
         
+        <div id="conflictModal" class="modal">
+            <div class="modal-content">
+                <h3>Files already exist</h3>
+                <div id="conflictList"></div>
+                <div class="modal-actions">
+                    <button class="cancel-btn" onclick="resolveUploadConflict(null)">Cancel</button>
+                    <button onclick="resolveUploadConflict('skip')">Skip these</button>
+                    <button onclick="resolveUploadConflict('rename')">Keep both</button>
+                    <button onclick="resolveUploadConflict('overwrite')">Replace</button>
+                </div>
+            </div>
+        </div>
+        
+        {{if .Trash}}
+        <div id="trashModal" class="modal">
+            <div class="modal-content tokens">
+                <h3>Trash</h3>
+                <div id="trashList"></div>
+                <div class="modal-actions">
+                    <button class="cancel-btn" onclick="emptyTrash()">Empty Trash</button>
+                    <button onclick="closeTrashModal()">Close</button>
+                </div>
+            </div>
+        </div>
+        {{end}}
+        
+        {{if .Versions}}
+        <div id="versionsModal" class="modal">
+            <div class="modal-content tokens">
+                <h3 id="versionsTitle">Version history</h3>
+                <div id="versionList"></div>
+                <div class="modal-actions">
+                    <button onclick="closeVersionsModal()">Close</button>
+                </div>
+            </div>
+        </div>
+        {{end}}
+        
+        {{if .Tokens}}
+        <div id="tokensModal" class="modal">
+            <div class="modal-content tokens">
+                <h3>API Tokens</h3>
+                <div id="tokenList"></div>
+                <h4>New token</h4>
+                <input type="text" id="tokenName" placeholder="Name, e.g. CI uploads">
+                <div>
+                    <label><input type="checkbox" class="token-scope" value="read" checked> read</label>
+                    <label><input type="checkbox" class="token-scope" value="write"> write</label>
+                    <label><input type="checkbox" class="token-scope" value="mkdir"> mkdir</label>
+                    <label><input type="checkbox" class="token-scope" value="delete"> delete</label>
+                    <label><input type="checkbox" class="token-scope" value="share"> share</label>
+                </div>
+                <input type="text" id="tokenPaths" placeholder="Limit to paths, comma separated (optional)">
+                <label>Expires <input type="date" id="tokenExpires"></label>
+                <div id="newToken" class="new-token"></div>
+                <div class="modal-actions">
+                    <button class="cancel-btn" onclick="closeTokensModal()">Close</button>
+                    <button onclick="createToken()">Create</button>
+                </div>
+            </div>
+        </div>
+        {{end}}
+        
         <h2>API Usage</h2>
         <div class="curl-examples">
+# When user accounts are enabled, add your credentials to any command
+curl -u alice http://localhost:8080/api/files
+
+# Or authenticate with an API token instead of a password
+curl -H "Authorization: Bearer gofs_..." http://localhost:8080/api/files
+
 # List files in root directory
 curl http://localhost:8080/api/files
 
@@ -467,35 +870,131 @@ curl http://localhost:8080/api/files?path=/my-dir
 curl -X POST -F "file=@/path/to/local/file.txt" http://localhost:8080/api/upload
 
 # Upload a file to a specific directory
-curl -X POST -F "file=@/path/to/local/file.txt" -F "path=/my-dir" http://localhost:8080/api/upload
+curl -X POST -F "path=/my-dir" -F "file=@/path/to/local/file.txt" http://localhost:8080/api/upload
+
+# Upload several files at once
+curl -X POST -F "path=/my-dir" -F "file=@a.txt" -F "file=@b.txt" http://localhost:8080/api/upload
+
+# Upload a file as the raw request body
+curl -T /path/to/local/file.txt http://localhost:8080/api/upload/my-dir/
 
 # Create a directory
 curl -X POST -H "Content-Type: application/json" -d '{"path":"/", "name":"new-dir"}' http://localhost:8080/api/mkdir
 
 # Download a file
 curl -O http://localhost:8080/download/my-dir/file.txt
+
+# Rename or move a file or directory
+curl -X POST -H "Content-Type: application/json" -d '{"from":"/my-dir/file.txt", "to":"/other-dir/file.txt"}' http://localhost:8080/api/move
+
+# Copy a file or directory, in the background for large trees
+curl -X POST -H "Content-Type: application/json" -d '{"from":"/my-dir", "to":"/my-dir-copy", "background":true}' http://localhost:8080/api/copy
+curl "http://localhost:8080/api/jobs?id=JOB_ID"
+
+# Download a directory as an archive (zip, tar or tar.gz)
+curl -OJ "http://localhost:8080/download/my-dir?format=zip"
+
+# Download several paths as one archive
+curl -OJ -d "path=/my-dir" -d "path=/file.txt" -d "format=tar.gz" http://localhost:8080/download/
+
+# Extract an archive next to it
+curl -X POST -H "Content-Type: application/json" -d '{"path":"/my-dir/data.zip"}' http://localhost:8080/api/extract
+
+# Share a file or folder as a public link, optionally limited
+curl -X POST -H "Content-Type: application/json" -d '{"path":"/my-dir", "expires":"2030-01-01", "password":"secret", "max_downloads":10}' http://localhost:8080/api/shares
+
+# Let others upload into a folder without seeing it, and send a file there
+curl -X POST -H "Content-Type: application/json" -d '{"path":"/inbox", "upload":true, "max_file_size":104857600, "file_types":["pdf"]}' http://localhost:8080/api/shares
+curl -F "file=@report.pdf" http://localhost:8080/s/SHARE_ID
+
+# Get a link that downloads a file without logging in, valid for a day
+curl -X POST -H "Content-Type: application/json" -d '{"path":"/my-dir/file.txt", "ttl":"24h"}' http://localhost:8080/api/sign
+
+# Delete a file, or a directory with everything in it, into the trash
+curl -X DELETE "http://localhost:8080/api/files?path=/my-dir/file.txt"
+curl -X DELETE "http://localhost:8080/api/files?path=/my-dir&recursive=true"
+
+# List the trash, restore an item, or delete it for good
+curl http://localhost:8080/api/trash
+curl -X POST -H "Content-Type: application/json" -d '{"id":"ITEM_ID"}' http://localhost:8080/api/trash
+curl -X DELETE "http://localhost:8080/api/trash?id=ITEM_ID"
+
+# Upload under a new name if the file exists, or check first which paths exist
+curl -F "conflict=rename" -F "file=@report.pdf" http://localhost:8080/api/upload
+curl -X POST -H "Content-Type: application/json" -d '{"paths":["/report.pdf"]}' http://localhost:8080/api/exists
+
+# Upload with a checksum the server verifies
+curl -H "X-Checksum-SHA256: $(sha256sum report.pdf | cut -d' ' -f1)" -T report.pdf http://localhost:8080/api/upload/report.pdf
+
+# Show how much space content-addressed storage saves
+curl http://localhost:8080/api/storage
+
+# List the versions of a file, download an old one or restore it
+curl "http://localhost:8080/api/versions?path=/report.pdf"
+curl -o old.pdf "http://localhost:8080/download/report.pdf?version=VERSION_ID"
+curl -X POST -H "Content-Type: application/json" -d '{"path":"/report.pdf","id":"VERSION_ID"}' http://localhost:8080/api/versions
         </div>
     </div>
     
     <script>
         let currentPath = '/';
+        const csrfToken = '{{.CSRFToken}}';
+        const inHome = {{if .Home}}true{{else}}false{{end}};
+        const sharing = {{if .Shares}}true{{else}}false{{end}};
+        const trashEnabled = {{if .Trash}}true{{else}}false{{end}};
+        const versioning = {{if .Versions}}true{{else}}false{{end}};
+        
+        // fetch with the CSRF token, reloading to the login form if the
+        // session has expired
+        function apiFetch(url, options) {
+            options = options || {};
+            options.headers = Object.assign({ 'X-CSRF-Token': csrfToken }, options.headers);
+            return fetch(url, options).then(function(response) {
+                if (response.status === 401) {
+                    window.location.reload();
+                }
+                return response;
+            });
+        }
         
         // Load files when the page loads
         window.onload = function() {
             loadFiles(currentPath);
+            
+            // Files dropped anywhere on the list go to the current directory
+            const fileList = document.getElementById('fileList');
+            fileList.addEventListener('dragover', function(event) {
+                if (!isFileDrag(event)) return;
+                event.preventDefault();
+                fileList.classList.add('drop-active');
+            });
+            fileList.addEventListener('dragleave', function(event) {
+                if (!fileList.contains(event.relatedTarget)) {
+                    fileList.classList.remove('drop-active');
+                }
+            });
+            fileList.addEventListener('drop', function(event) {
+                fileList.classList.remove('drop-active');
+                if (!isFileDrag(event)) return;
+                event.preventDefault();
+                collectDropped(event.dataTransfer).then(items => uploadFiles(items, currentPath));
+            });
         };
         
         // Function to load files from the current path
         function loadFiles(path) {
             currentPath = path;
-            document.getElementById('pathDisplay').textContent = currentPath;
+            // Paths of users with a home directory are shown relative to it
+            document.getElementById('pathDisplay').textContent =
+                inHome ? '~' + (currentPath === '/' ? '' : currentPath) : currentPath;
             
-            fetch('/api/files?path=' + encodeURIComponent(path))
+            apiFetch('/api/files?path=' + encodeURIComponent(path))
                 .then(function(response) { return response.json(); })
                 .then(function(data) {
                                             if (data.success) {
                         const fileList = document.getElementById('fileList');
                         fileList.innerHTML = '';
+                        updateSelection();
                         
                         // Check if files array exists and handle if it's null or missing
                         if (!data.files || data.files.length === 0) {
@@ -515,6 +1014,12 @@ curl -O http://localhost:8080/download/my-dir/file.txt
                             fileItem.className = 'file-item';
                             
                             const isDir = file.is_dir;
+                            const select = document.createElement('input');
+                            select.type = 'checkbox';
+                            select.className = 'select';
+                            select.value = file.path;
+                            select.onchange = updateSelection;
+                            
                             const icon = document.createElement('div');
                             icon.className = 'icon';
                             icon.innerHTML = isDir ? '📁' : '📄';
@@ -529,7 +1034,7 @@ curl -O http://localhost:8080/download/my-dir/file.txt
                                 link.href = 'javascript:void(0)';
                                 link.onclick = () => loadFiles(file.path);
                             } else {
-                                link.href = '/download' + file.path;
+                                link.href = downloadURL(file.path);
                                 link.setAttribute('download', '');
                             }
                             
@@ -539,11 +1044,83 @@ curl -O http://localhost:8080/download/my-dir/file.txt
                             meta.className = 'meta';
                             if (!isDir) {
                                 meta.textContent = formatFileSize(file.size);
+                                if (file.hashes && file.hashes.sha256) meta.title = 'SHA-256 ' + file.hashes.sha256;
+                            } else {
+                                const zipLink = document.createElement('a');
+                                zipLink.href = downloadURL(file.path) + '?format=zip';
+                                zipLink.textContent = 'Download as ZIP';
+                                meta.appendChild(zipLink);
                             }
                             
+                            const renameBtn = document.createElement('button');
+                            renameBtn.className = 'rename-btn';
+                            renameBtn.title = 'Rename';
+                            renameBtn.textContent = '✎';
+                            renameBtn.onclick = () => startRename(file, name);
+                            
+                            const deleteBtn = document.createElement('button');
+                            deleteBtn.className = 'delete-btn';
+                            deleteBtn.title = 'Delete';
+                            deleteBtn.textContent = '✕';
+                            deleteBtn.onclick = () => deleteFile(file);
+                            
+                            fileItem.appendChild(select);
                             fileItem.appendChild(icon);
                             fileItem.appendChild(name);
                             fileItem.appendChild(meta);
+                            if (sharing) {
+                                const shareBtn = document.createElement('button');
+                                shareBtn.className = 'rename-btn';
+                                shareBtn.title = 'Share link';
+                                shareBtn.textContent = '🔗';
+                                shareBtn.onclick = () => shareFile(file);
+                                fileItem.appendChild(shareBtn);
+                                if (isDir) {
+                                    const requestBtn = document.createElement('button');
+                                    requestBtn.className = 'rename-btn';
+                                    requestBtn.title = 'Upload link';
+                                    requestBtn.textContent = '📥';
+                                    requestBtn.onclick = () => requestFiles(file);
+                                    fileItem.appendChild(requestBtn);
+                                }
+                            }
+                            if (versioning && !isDir) {
+                                const historyBtn = document.createElement('button');
+                                historyBtn.className = 'rename-btn';
+                                historyBtn.title = 'Version history';
+                                historyBtn.textContent = '🕘';
+                                historyBtn.onclick = () => openVersionsModal(file);
+                                fileItem.appendChild(historyBtn);
+                            }
+                            fileItem.appendChild(renameBtn);
+                            fileItem.appendChild(deleteBtn);
+                            
+                            // Any row can be dragged, directory rows accept drops
+                            fileItem.draggable = true;
+                            fileItem.addEventListener('dragstart', function(event) {
+                                event.dataTransfer.setData('text/plain', file.path);
+                            });
+                            if (isDir) {
+                                fileItem.addEventListener('dragover', function(event) {
+                                    event.preventDefault();
+                                    fileItem.classList.add('drop-target');
+                                });
+                                fileItem.addEventListener('dragleave', function() {
+                                    fileItem.classList.remove('drop-target');
+                                });
+                                fileItem.addEventListener('drop', function(event) {
+                                    event.preventDefault();
+                                    event.stopPropagation();
+                                    fileItem.classList.remove('drop-target');
+                                    if (isFileDrag(event)) {
+                                        collectDropped(event.dataTransfer).then(items => uploadFiles(items, file.path));
+                                        return;
+                                    }
+                                    const from = event.dataTransfer.getData('text/plain');
+                                    if (!from || from === file.path) return;
+                                    moveFile(from, joinPath(file.path, baseName(from)));
+                                });
+                            }
                             
                             fileList.appendChild(fileItem);
                         });
@@ -557,55 +1134,312 @@ curl -O http://localhost:8080/download/my-dir/file.txt
                 });
         }
         
+        // Function to enable the selection download when something is checked
+        function updateSelection() {
+            const checked = document.querySelectorAll('#fileList .select:checked');
+            document.getElementById('downloadSelected').disabled = checked.length === 0;
+        }
+        
+        // Function to download the checked files and directories as one ZIP
+        function downloadSelected() {
+            const checked = document.querySelectorAll('#fileList .select:checked');
+            if (!checked.length) return;
+            
+            // A form submission lets the browser handle the streamed download
+            const form = document.createElement('form');
+            form.method = 'POST';
+            form.action = '/download/';
+            const token = document.createElement('input');
+            token.type = 'hidden';
+            token.name = 'csrf_token';
+            token.value = csrfToken;
+            form.appendChild(token);
+            checked.forEach(function(box) {
+                const input = document.createElement('input');
+                input.type = 'hidden';
+                input.name = 'path';
+                input.value = box.value;
+                form.appendChild(input);
+            });
+            const format = document.createElement('input');
+            format.type = 'hidden';
+            format.name = 'format';
+            format.value = 'zip';
+            form.appendChild(format);
+            
+            document.body.appendChild(form);
+            form.submit();
+            document.body.removeChild(form);
+        }
+        
+        // Function to build the download URL of a path, escaping each segment
+        function downloadURL(path) {
+            return '/download' + path.split('/').map(encodeURIComponent).join('/');
+        }
+        
         // Function to navigate to parent directory
         function navigateToParent() {
             if (currentPath === '/') return;
             
-            const parts = currentPath.split('/').filter(Boolean);
-            parts.pop();
-            const parentPath = parts.length ? '/' + parts.join('/') : '/';
-            loadFiles(parentPath);
+            loadFiles(parentPath(currentPath));
         }
         
-        // Function to upload a file
-        function uploadFile() {
-            const fileInput = document.getElementById('fileInput');
-            if (!fileInput.files.length) return;
+        // Function to upload the files picked in a file input
+        function uploadFromInput(input) {
+            if (!input.files.length) return;
             
-            const formData = new FormData();
-            formData.append('file', fileInput.files[0]);
-            formData.append('path', currentPath);
+            // Folder picks carry the path relative to the chosen folder
+            const items = Array.from(input.files).map(function(file) {
+                return { file: file, name: file.webkitRelativePath || file.name };
+            });
+            uploadFiles(items, currentPath);
             
-            // Show spinner
-            document.getElementById('spinner').style.display = 'inline-block';
+            // Reset file input
+            input.value = '';
+        }
+        
+        // Files at least this large use resumable uploads, sent in chunks
+        const TUS_THRESHOLD = 16 * 1024 * 1024;
+        const TUS_CHUNK_SIZE = 8 * 1024 * 1024;
+        
+        // Function to upload files, each with a name that may include directories
+        function uploadFiles(items, targetPath) {
+            if (!items.length) return;
+            
+            // Ask what to do about existing files before sending anything
+            checkExisting(items, targetPath).then(result => {
+                if (!result) return;
+                items = result.items;
+                if (!items.length) return;
+                
+                const small = items.filter(item => item.file.size < TUS_THRESHOLD);
+                const large = items.filter(item => item.file.size >= TUS_THRESHOLD);
+                
+                // Show spinner
+                document.getElementById('spinner').style.display = 'inline-block';
+                
+                // Small files go in one request, large ones one after another
+                let chain = small.length ? uploadMultipart(small, targetPath, result.conflict) : Promise.resolve([]);
+                large.forEach(function(item) {
+                    chain = chain.then(messages => uploadResumable(item, targetPath, result.conflict)
+                        .then(message => messages.concat([message]))
+                        .catch(error => messages.concat(['Error: ' + item.name + ': ' + error.message])));
+                });
+                
+                return chain.then(messages => {
+                    alert(messages.join('\n'));
+                })
+                .finally(() => {
+                    // Hide spinner
+                    document.getElementById('spinner').style.display = 'none';
+                    document.getElementById('uploadProgress').textContent = '';
+                    loadFiles(currentPath); // Reload files
+                });
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Upload failed. See console for details.');
+            });
+        }
+        
+        // Function to find the items that would replace an existing file and
+        // let the user choose to replace them, keep both, or skip them.
+        // Resolves to the items to send and the conflict policy, or null if
+        // the upload was cancelled. Without collisions nothing may be
+        // replaced, in case another upload got there first.
+        function checkExisting(items, targetPath) {
+            return apiFetch('/api/exists', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ paths: items.map(item => joinPath(targetPath, item.name)) })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (!data.success) throw new Error(data.error);
+                if (!data.existing.length) return { items: items, conflict: 'fail' };
+                
+                const taken = new Set(data.existing.map(entry => entry.path));
+                const list = document.getElementById('conflictList');
+                list.innerHTML = '';
+                data.existing.slice(0, 10).forEach(function(entry) {
+                    const row = document.createElement('div');
+                    row.textContent = (entry.is_dir ? '📁 ' : '📄 ') + entry.path;
+                    list.appendChild(row);
+                });
+                if (data.existing.length > 10) {
+                    const more = document.createElement('div');
+                    more.textContent = 'and ' + (data.existing.length - 10) + ' more';
+                    list.appendChild(more);
+                }
+                document.getElementById('conflictModal').style.display = 'block';
+                
+                return new Promise(resolve => { conflictChoice = resolve; }).then(choice => {
+                    if (!choice) return null;
+                    if (choice === 'skip') {
+                        return { items: items.filter(item => !taken.has(joinPath(targetPath, item.name))), conflict: 'fail' };
+                    }
+                    return { items: items, conflict: choice };
+                });
+            });
+        }
+        
+        let conflictChoice = null;
+        
+        function resolveUploadConflict(choice) {
+            document.getElementById('conflictModal').style.display = 'none';
+            if (conflictChoice) conflictChoice(choice);
+            conflictChoice = null;
+        }
+        
+        // Function to upload files in a single multipart request
+        function uploadMultipart(items, targetPath, conflict) {
+            // The path must come before the files, the server streams parts in order
+            const formData = new FormData();
+            formData.append('path', targetPath);
+            formData.append('conflict', conflict);
+            items.forEach(function(item) {
+                formData.append('file', item.file, item.name);
+            });
             
-            fetch('/api/upload', {
+            return apiFetch('/api/upload', {
                 method: 'POST',
                 body: formData
             })
             .then(response => response.json())
             .then(data => {
-                // Hide spinner
-                document.getElementById('spinner').style.display = 'none';
-                
                 if (data.success) {
-                    alert(data.message);
-                    loadFiles(currentPath); // Reload files
-                } else {
-                    alert('Error: ' + data.error);
+                    return [data.message];
+                }
+                const failures = (data.files || []).filter(f => !f.success);
+                return ['Error: ' + data.error + failures.map(f => '\n' + f.name + ': ' + f.error).join('')];
+            });
+        }
+        
+        // Function to upload one file with the tus protocol. The upload URL is
+        // remembered, so choosing the same file again after a reload resumes it.
+        function uploadResumable(item, targetPath, conflict) {
+            const key = 'tus:' + targetPath + ':' + item.name + ':' + item.file.size + ':' + item.file.lastModified;
+            const stored = localStorage.getItem(key);
+            
+            const start = stored
+                ? apiFetch(stored, { method: 'HEAD', headers: { 'Tus-Resumable': '1.0.0' } })
+                    .then(response => response.ok
+                        ? { url: stored, offset: parseInt(response.headers.get('Upload-Offset'), 10) }
+                        : createResumable(item, targetPath, key, conflict))
+                : createResumable(item, targetPath, key, conflict);
+            
+            return start
+                .then(state => sendChunks(item, state.url, state.offset, 0))
+                .then(() => {
+                    localStorage.removeItem(key);
+                    return 'File uploaded successfully to ' + joinPath(targetPath, item.name);
+                });
+        }
+        
+        function createResumable(item, targetPath, key, conflict) {
+            return apiFetch('/api/tus/', {
+                method: 'POST',
+                headers: {
+                    'Tus-Resumable': '1.0.0',
+                    'Upload-Length': String(item.file.size),
+                    'Upload-Metadata': 'filename ' + base64(item.name) + ',path ' + base64(targetPath) +
+                        ',conflict ' + base64(conflict)
                 }
-                
-                // Reset file input
-                fileInput.value = '';
             })
-            .catch(error => {
-                // Hide spinner
-                document.getElementById('spinner').style.display = 'none';
-                console.error('Error:', error);
-                alert('Upload failed. See console for details.');
+            .then(response => {
+                if (response.status !== 201) {
+                    return response.json().then(data => { throw new Error(data.error); });
+                }
+                const url = response.headers.get('Location');
+                localStorage.setItem(key, url);
+                return { url: url, offset: 0 };
+            });
+        }
+        
+        // Send the rest of the file from offset, retrying with backoff and
+        // asking the server where to continue after a failure
+        function sendChunks(item, url, offset, retries) {
+            const size = item.file.size;
+            document.getElementById('uploadProgress').textContent =
+                item.name + ': ' + Math.floor(offset * 100 / size) + '%';
+            if (offset >= size) return Promise.resolve();
+            
+            return apiFetch(url, {
+                method: 'PATCH',
+                headers: {
+                    'Tus-Resumable': '1.0.0',
+                    'Upload-Offset': String(offset),
+                    'Content-Type': 'application/offset+octet-stream'
+                },
+                body: item.file.slice(offset, offset + TUS_CHUNK_SIZE)
+            })
+            .then(response => {
+                if (response.status !== 204) {
+                    throw new Error('Server responded with status ' + response.status);
+                }
+                return parseInt(response.headers.get('Upload-Offset'), 10);
+            })
+            .then(next => sendChunks(item, url, next, 0), error => {
+                if (retries >= 5) throw error;
+                const delay = 1000 * Math.pow(2, retries);
+                return new Promise(resolve => setTimeout(resolve, delay))
+                    .then(() => apiFetch(url, { method: 'HEAD', headers: { 'Tus-Resumable': '1.0.0' } }))
+                    .then(response => {
+                        if (!response.ok) throw error;
+                        return sendChunks(item, url, parseInt(response.headers.get('Upload-Offset'), 10), retries + 1);
+                    });
             });
         }
         
+        function base64(text) {
+            return btoa(unescape(encodeURIComponent(text)));
+        }
+        
+        // Function to collect dropped files, walking into dropped folders
+        function collectDropped(dataTransfer) {
+            const entries = [];
+            Array.from(dataTransfer.items || []).forEach(function(item) {
+                const entry = item.webkitGetAsEntry && item.webkitGetAsEntry();
+                if (entry) entries.push(entry);
+            });
+            if (!entries.length) {
+                return Promise.resolve(Array.from(dataTransfer.files).map(function(file) {
+                    return { file: file, name: file.name };
+                }));
+            }
+            return Promise.all(entries.map(e => readEntry(e, ''))).then(lists => [].concat(...lists));
+        }
+        
+        function readEntry(entry, prefix) {
+            if (entry.isFile) {
+                return new Promise(function(resolve, reject) {
+                    entry.file(file => resolve([{ file: file, name: prefix + file.name }]), reject);
+                });
+            }
+            
+            // Directory readers return entries in batches until an empty one
+            const reader = entry.createReader();
+            const children = [];
+            return new Promise(function(resolve, reject) {
+                const readBatch = function() {
+                    reader.readEntries(function(batch) {
+                        if (batch.length) {
+                            children.push(...batch);
+                            readBatch();
+                            return;
+                        }
+                        Promise.all(children.map(e => readEntry(e, prefix + entry.name + '/')))
+                            .then(lists => resolve([].concat(...lists)), reject);
+                    }, reject);
+                };
+                readBatch();
+            });
+        }
+        
+        function isFileDrag(event) {
+            return Array.from(event.dataTransfer.types).indexOf('Files') !== -1;
+        }
+        
         // Modal functions
         function openMkdirModal() {
             document.getElementById('mkdirModal').style.display = 'block';
@@ -625,7 +1459,7 @@ curl -O http://localhost:8080/download/my-dir/file.txt
                 return;
             }
             
-            fetch('/api/mkdir', {
+            apiFetch('/api/mkdir', {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json'
@@ -650,6 +1484,110 @@ curl -O http://localhost:8080/download/my-dir/file.txt
             });
         }
         
+        // Function to replace a file name with an input for renaming in place
+        function startRename(file, nameEl) {
+            const input = document.createElement('input');
+            input.type = 'text';
+            input.value = file.name;
+            nameEl.innerHTML = '';
+            nameEl.appendChild(input);
+            input.focus();
+            input.select();
+            
+            let done = false;
+            const finish = function(commit) {
+                if (done) return;
+                done = true;
+                const newName = input.value.trim();
+                if (commit && newName && newName !== file.name) {
+                    moveFile(file.path, joinPath(parentPath(file.path), newName));
+                } else {
+                    loadFiles(currentPath);
+                }
+            };
+            input.addEventListener('keyup', function(event) {
+                if (event.key === 'Enter') finish(true);
+                if (event.key === 'Escape') finish(false);
+            });
+            input.addEventListener('blur', function() { finish(false); });
+        }
+        
+        // Function to move or rename, asking before overwriting an existing target
+        function moveFile(from, to, conflict) {
+            apiFetch('/api/move', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({
+                    from: from,
+                    to: to,
+                    conflict: conflict || 'fail'
+                })
+            })
+            .then(response => response.json().then(data => ({ status: response.status, data: data })))
+            .then(result => {
+                if (result.data.success) {
+                    loadFiles(currentPath); // Reload files
+                } else if (result.status === 409 && confirm('"' + to + '" already exists. Overwrite it?')) {
+                    moveFile(from, to, 'overwrite');
+                } else {
+                    alert('Error: ' + result.data.error);
+                    loadFiles(currentPath);
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Failed to move. See console for details.');
+            });
+        }
+        
+        // Path helpers
+        function parentPath(path) {
+            const parts = path.split('/').filter(Boolean);
+            parts.pop();
+            return parts.length ? '/' + parts.join('/') : '/';
+        }
+        
+        function baseName(path) {
+            const parts = path.split('/').filter(Boolean);
+            return parts.length ? parts[parts.length - 1] : '';
+        }
+        
+        function joinPath(dir, name) {
+            return (dir === '/' ? '' : dir) + '/' + name;
+        }
+        
+        // Function to delete a file or directory
+        function deleteFile(file) {
+            let message = file.is_dir
+                ? 'Delete directory "' + file.name + '" and everything in it?'
+                : 'Delete file "' + file.name + '"?';
+            if (trashEnabled) {
+                message += ' It can be restored from the trash.';
+            }
+            if (!confirm(message)) return;
+            
+            let url = '/api/files?path=' + encodeURIComponent(file.path);
+            if (file.is_dir) {
+                url += '&recursive=true';
+            }
+            
+            apiFetch(url, { method: 'DELETE' })
+            .then(response => response.json())
+            .then(data => {
+                if (data.success) {
+                    loadFiles(currentPath); // Reload files
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Failed to delete. See console for details.');
+            });
+        }
+        
         // Utility function to format file size
         function formatFileSize(bytes) {
             if (bytes === 0) return '0 Bytes';
@@ -661,6 +1599,377 @@ curl -O http://localhost:8080/download/my-dir/file.txt
             return parseFloat((bytes / Math.pow(k, i)).toFixed(2)) + ' ' + sizes[i];
         }
         
+        // Create a public link, asking for the optional limits
+        function shareFile(file) {
+            const days = prompt('Share "' + file.name + '": expire after how many days? (empty for never)', '7');
+            if (days === null) return;
+            const password = prompt('Password for the link? (empty for none)', '');
+            if (password === null) return;
+            
+            let expires = '';
+            if (days.trim()) {
+                expires = new Date(Date.now() + parseFloat(days) * 86400000).toISOString();
+            }
+            
+            apiFetch('/api/shares', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ path: file.path, expires: expires, password: password })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (data.success) {
+                    prompt('Share link:', window.location.origin + data.share.url);
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Failed to create share. See console for details.');
+            });
+        }
+        
+        // Create an upload-only link for a folder, asking for the optional limits
+        function requestFiles(file) {
+            const days = prompt('Upload link for "' + file.name + '": expire after how many days? (empty for never)', '7');
+            if (days === null) return;
+            const size = prompt('Largest file in MB? (empty for no limit)', '');
+            if (size === null) return;
+            const types = prompt('Allowed file types, comma separated, e.g. pdf, docx? (empty for any)', '');
+            if (types === null) return;
+            
+            let expires = '';
+            if (days.trim()) {
+                expires = new Date(Date.now() + parseFloat(days) * 86400000).toISOString();
+            }
+            
+            apiFetch('/api/shares', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    path: file.path,
+                    upload: true,
+                    expires: expires,
+                    max_file_size: size.trim() ? Math.round(parseFloat(size) * 1024 * 1024) : 0,
+                    file_types: types.split(',').map(t => t.trim()).filter(t => t)
+                })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (data.success) {
+                    prompt('Upload link:', window.location.origin + data.share.url);
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Failed to create upload link. See console for details.');
+            });
+        }
+        
+        function openTrashModal() {
+            document.getElementById('trashModal').style.display = 'block';
+            loadTrash();
+        }
+        
+        function closeTrashModal() {
+            document.getElementById('trashModal').style.display = 'none';
+            loadFiles(currentPath);
+        }
+        
+        // List deleted items with restore and delete buttons each
+        function loadTrash() {
+            apiFetch('/api/trash')
+                .then(response => response.json())
+                .then(data => {
+                    const list = document.getElementById('trashList');
+                    list.innerHTML = '';
+                    if (!data.success) {
+                        list.textContent = data.error;
+                        return;
+                    }
+                    if (!data.items.length) {
+                        list.textContent = 'The trash is empty.';
+                    }
+                    data.items.forEach(function(item) {
+                        const row = document.createElement('div');
+                        row.className = 'token-item';
+                        
+                        const info = document.createElement('span');
+                        info.textContent = (item.is_dir ? '📁 ' : '📄 ') + item.path + ' ';
+                        const meta = document.createElement('span');
+                        meta.className = 'meta';
+                        meta.textContent = formatFileSize(item.size) + ', deleted ' + item.deleted_at +
+                            (item.deleted_by ? ' by ' + item.deleted_by : '') + ', purged ' + item.purge_at;
+                        info.appendChild(meta);
+                        row.appendChild(info);
+                        
+                        const buttons = document.createElement('span');
+                        const restore = document.createElement('button');
+                        restore.textContent = 'Restore';
+                        restore.onclick = function() { restoreItem(item); };
+                        const remove = document.createElement('button');
+                        remove.className = 'cancel-btn';
+                        remove.textContent = 'Delete';
+                        remove.onclick = function() { deleteTrashItem(item); };
+                        buttons.appendChild(restore);
+                        buttons.appendChild(document.createTextNode(' '));
+                        buttons.appendChild(remove);
+                        row.appendChild(buttons);
+                        
+                        list.appendChild(row);
+                    });
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        // Restore to the original place, offering to keep both if it is taken
+        function restoreItem(item, conflict) {
+            apiFetch('/api/trash', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ id: item.id, conflict: conflict || 'fail' })
+            })
+            .then(response => response.json().then(data => ({ status: response.status, data: data })))
+            .then(result => {
+                if (result.data.success) {
+                    loadTrash();
+                } else if (result.status === 409 && confirm('"' + item.path + '" already exists. Restore it under a new name?')) {
+                    restoreItem(item, 'autorename');
+                } else if (result.status !== 409) {
+                    alert('Error: ' + result.data.error);
+                }
+            })
+            .catch(error => console.error('Error:', error));
+        }
+        
+        function deleteTrashItem(item) {
+            if (!confirm('Permanently delete "' + item.path + '"? This cannot be undone.')) return;
+            
+            apiFetch('/api/trash?id=' + encodeURIComponent(item.id), { method: 'DELETE' })
+                .then(response => response.json())
+                .then(data => {
+                    if (!data.success) alert('Error: ' + data.error);
+                    loadTrash();
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        function emptyTrash() {
+            if (!confirm('Permanently delete everything in the trash? This cannot be undone.')) return;
+            
+            apiFetch('/api/trash', { method: 'DELETE' })
+                .then(response => response.json())
+                .then(data => {
+                    if (!data.success) alert('Error: ' + data.error);
+                    loadTrash();
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        let versionsFile = null;
+        
+        function openVersionsModal(file) {
+            versionsFile = file;
+            document.getElementById('versionsTitle').textContent = 'Version history of ' + file.name;
+            document.getElementById('versionsModal').style.display = 'block';
+            loadVersions();
+        }
+        
+        function closeVersionsModal() {
+            document.getElementById('versionsModal').style.display = 'none';
+            versionsFile = null;
+            loadFiles(currentPath);
+        }
+        
+        // List the current content and the kept versions of a file, newest
+        // first, with download, restore and delete buttons for each version
+        function loadVersions() {
+            const file = versionsFile;
+            apiFetch('/api/versions?path=' + encodeURIComponent(file.path))
+                .then(response => response.json())
+                .then(data => {
+                    const list = document.getElementById('versionList');
+                    list.innerHTML = '';
+                    if (!data.success) {
+                        list.textContent = data.error;
+                        return;
+                    }
+                    data.versions.forEach(function(version) {
+                        const row = document.createElement('div');
+                        row.className = 'token-item';
+                        
+                        const info = document.createElement('span');
+                        info.textContent = (version.current ? 'Current' : version.time) + ' ';
+                        const meta = document.createElement('span');
+                        meta.className = 'meta';
+                        meta.textContent = formatFileSize(version.size) +
+                            (version.current ? ', ' + version.time : '') +
+                            (version.uploader ? ' by ' + version.uploader : '') +
+                            (version.sha256 ? ', SHA-256 ' + version.sha256.slice(0, 12) : '');
+                        if (version.sha256) meta.title = version.sha256;
+                        info.appendChild(meta);
+                        row.appendChild(info);
+                        
+                        if (!version.current) {
+                            const buttons = document.createElement('span');
+                            const download = document.createElement('a');
+                            download.href = downloadURL(file.path) + '?version=' + encodeURIComponent(version.id);
+                            download.textContent = 'Download';
+                            const restore = document.createElement('button');
+                            restore.textContent = 'Restore';
+                            restore.onclick = function() { restoreVersion(file, version); };
+                            const remove = document.createElement('button');
+                            remove.className = 'cancel-btn';
+                            remove.textContent = 'Delete';
+                            remove.onclick = function() { deleteVersion(file, version); };
+                            buttons.appendChild(download);
+                            buttons.appendChild(document.createTextNode(' '));
+                            buttons.appendChild(restore);
+                            buttons.appendChild(document.createTextNode(' '));
+                            buttons.appendChild(remove);
+                            row.appendChild(buttons);
+                        }
+                        
+                        list.appendChild(row);
+                    });
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        function restoreVersion(file, version) {
+            if (!confirm('Restore the version of ' + version.time + '? The current content is kept as a version.')) return;
+            
+            apiFetch('/api/versions', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ path: file.path, id: version.id })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (!data.success) alert('Error: ' + data.error);
+                loadVersions();
+            })
+            .catch(error => console.error('Error:', error));
+        }
+        
+        function deleteVersion(file, version) {
+            if (!confirm('Permanently delete the version of ' + version.time + '?')) return;
+            
+            apiFetch('/api/versions?path=' + encodeURIComponent(file.path) + '&id=' + encodeURIComponent(version.id), { method: 'DELETE' })
+                .then(response => response.json())
+                .then(data => {
+                    if (!data.success) alert('Error: ' + data.error);
+                    loadVersions();
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        function openTokensModal() {
+            document.getElementById('tokensModal').style.display = 'block';
+            document.getElementById('newToken').textContent = '';
+            loadTokens();
+        }
+        
+        function closeTokensModal() {
+            document.getElementById('tokensModal').style.display = 'none';
+            document.getElementById('newToken').textContent = '';
+        }
+        
+        // List the user's tokens with a revoke button each
+        function loadTokens() {
+            apiFetch('/api/tokens')
+                .then(response => response.json())
+                .then(data => {
+                    const list = document.getElementById('tokenList');
+                    list.innerHTML = '';
+                    if (!data.success) {
+                        list.textContent = data.error;
+                        return;
+                    }
+                    if (!data.tokens.length) {
+                        list.textContent = 'No tokens yet.';
+                    }
+                    data.tokens.forEach(function(token) {
+                        const item = document.createElement('div');
+                        item.className = 'token-item';
+                        
+                        const info = document.createElement('span');
+                        info.textContent = token.name + ' ';
+                        const meta = document.createElement('span');
+                        meta.className = 'meta';
+                        meta.textContent = token.scopes.join(', ') +
+                            (token.paths ? ' on ' + token.paths.join(', ') : '') +
+                            (token.expires ? (token.expired ? ', expired ' : ', expires ') + token.expires : '') +
+                            (token.last_used ? ', last used ' + token.last_used : '');
+                        info.appendChild(meta);
+                        item.appendChild(info);
+                        
+                        const revoke = document.createElement('button');
+                        revoke.className = 'cancel-btn';
+                        revoke.textContent = 'Revoke';
+                        revoke.onclick = function() { revokeToken(token); };
+                        item.appendChild(revoke);
+                        
+                        list.appendChild(item);
+                    });
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
+        // Create a token and show its secret, which is only returned once
+        function createToken() {
+            const name = document.getElementById('tokenName').value.trim();
+            if (!name) {
+                alert('Please enter a token name');
+                return;
+            }
+            const scopes = Array.from(document.querySelectorAll('.token-scope:checked')).map(box => box.value);
+            const paths = document.getElementById('tokenPaths').value.split(',').map(p => p.trim()).filter(p => p);
+            
+            apiFetch('/api/tokens', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    name: name,
+                    scopes: scopes,
+                    paths: paths,
+                    expires: document.getElementById('tokenExpires').value
+                })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (data.success) {
+                    document.getElementById('newToken').textContent = data.message + ': ' + data.token;
+                    document.getElementById('tokenName').value = '';
+                    loadTokens();
+                } else {
+                    alert('Error: ' + data.error);
+                }
+            })
+            .catch(error => {
+                console.error('Error:', error);
+                alert('Failed to create token. See console for details.');
+            });
+        }
+        
+        function revokeToken(token) {
+            if (!confirm('Revoke token "' + token.name + '"? Scripts using it will stop working.')) return;
+            
+            apiFetch('/api/tokens?id=' + encodeURIComponent(token.id), { method: 'DELETE' })
+                .then(response => response.json())
+                .then(data => {
+                    if (data.success) {
+                        loadTokens();
+                    } else {
+                        alert('Error: ' + data.error);
+                    }
+                })
+                .catch(error => console.error('Error:', error));
+        }
+        
         // Handle Enter key in the directory name input
         document.getElementById('dirName').addEventListener('keyup', function(event) {
             if (event.key === 'Enter' || event.keyCode === 13) {
@@ -668,6 +1977,7 @@ curl -O http://localhost:8080/download/my-dir/file.txt
             }
         });
     </script>
+    {{end}}
 </body>
 </html>
 `
\ No newline at end of file
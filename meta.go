@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// What the server knows about files, such as who uploaded them, their
+// hashes and their versions, is kept in a tree below sidecarDirName that
+// mirrors the upload directory, so moving a file or directory only needs
+// the matching rename there. Entries inside a mirrored directory use the
+// internal prefix, so they cannot clash with the names of real children.
+const (
+	sidecarDirName = internalPrefix + "meta"
+	fileMetaName   = internalPrefix + "file.json"
+)
+
+// fileMeta records who wrote the current content of a file and its hashes.
+// It only applies while the file's size and modification time still match,
+// so changes made outside the server are never described wrongly.
+type fileMeta struct {
+	Uploader string    `json:"uploader,omitempty"`
+	Hashes   checksums `json:"hashes,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+}
+
+// sidecarDir returns the mirrored directory of a resolved path in the
+// sidecar tree
+func sidecarDir(fullPath string) string {
+	rel, err := filepath.Rel(config.UploadPath, fullPath)
+	if err != nil || rel == "." {
+		rel = ""
+	}
+	return filepath.Join(config.UploadPath, sidecarDirName, rel)
+}
+
+// readMeta returns what is known about the current content of a file, or
+// nil if it was written by other means since
+func readMeta(fullPath string, info fs.FileInfo) *fileMeta {
+	data, err := readStored(filepath.Join(sidecarDir(fullPath), fileMetaName))
+	if err != nil {
+		return nil
+	}
+	var meta fileMeta
+	if json.Unmarshal(data, &meta) != nil || meta.Size != info.Size() || !meta.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+	return &meta
+}
+
+// writeMeta records who wrote the current content of a file and its hashes
+func writeMeta(fullPath, uploader string, sums checksums) {
+	info, err := storage.Stat(fullPath)
+	if err != nil {
+		return
+	}
+	dir := sidecarDir(fullPath)
+	if err := storage.Mkdir(dir, 0700); err != nil {
+		log.Printf("Failed to record metadata of %s: %v", fullPath, err)
+		return
+	}
+	err = saveStored(filepath.Join(dir, fileMetaName), fileMeta{
+		Uploader: uploader,
+		Hashes:   sums,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		log.Printf("Failed to record metadata of %s: %v", fullPath, err)
+	}
+}
+
+// moveSidecar makes the metadata and versions below one path follow a file
+// or directory that was moved to another. A file that replaced another takes
+// over its versions.
+func moveSidecar(fromPath, toPath string) {
+	from, to := sidecarDir(fromPath), sidecarDir(toPath)
+	if info, err := storage.Stat(toPath); err == nil && !info.IsDir() {
+		moveFileSidecar(from, to)
+		return
+	}
+	if _, err := storage.Stat(from); err != nil {
+		return
+	}
+	storage.Remove(to)
+	if err := storage.Mkdir(filepath.Dir(to), 0700); err != nil {
+		return
+	}
+	if err := storage.Rename(from, to); err != nil {
+		log.Printf("Failed to move metadata of %s: %v", fromPath, err)
+	}
+}
+
+// moveFileSidecar moves the metadata and versions of a file into the
+// sidecar directory of another, keeping the versions there
+func moveFileSidecar(from, to string) {
+	storage.Remove(filepath.Join(to, fileMetaName))
+	if _, err := storage.Stat(from); err != nil {
+		return
+	}
+	if err := storage.Mkdir(to, 0700); err != nil {
+		log.Printf("Failed to move metadata of %s: %v", from, err)
+		return
+	}
+	storage.Rename(filepath.Join(from, fileMetaName), filepath.Join(to, fileMetaName))
+
+	versions, _ := storage.List(filepath.Join(from, versionEntriesName))
+	if len(versions) > 0 {
+		if err := storage.Mkdir(filepath.Join(to, versionEntriesName), 0700); err != nil {
+			log.Printf("Failed to move versions of %s: %v", from, err)
+			return
+		}
+	}
+	for _, v := range versions {
+		storage.Rename(filepath.Join(from, versionEntriesName, v.Name()), filepath.Join(to, versionEntriesName, v.Name()))
+	}
+	storage.Remove(from)
+}
+
+// dropSidecar removes the metadata and versions of a path and everything
+// below it
+func dropSidecar(fullPath string) {
+	if !rootView.isRoot(fullPath) {
+		storage.Remove(sidecarDir(fullPath))
+	}
+}
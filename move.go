@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Conflict policies for operations that write to an existing path
+const (
+	conflictFail       = "fail"
+	conflictOverwrite  = "overwrite"
+	conflictAutorename = "autorename"
+	conflictRename     = "rename" // the name uploads use for autorename
+)
+
+// handleAPIMove renames or moves a file or directory
+func handleAPIMove(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Conflict string `json:"conflict"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.Conflict == "" {
+		reqBody.Conflict = conflictFail
+	}
+	if reqBody.Conflict != conflictFail && reqBody.Conflict != conflictOverwrite && reqBody.Conflict != conflictAutorename {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or autorename", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fromPath, err := resolvePath(r, reqBody.From)
+	if err != nil || reqBody.From == "" {
+		sendJSONError(w, "Invalid source path", http.StatusBadRequest)
+		return
+	}
+	toPath, err := resolvePath(r, reqBody.To)
+	if err != nil || reqBody.To == "" {
+		sendJSONError(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	if isRoot(r, fromPath) || isRoot(r, toPath) {
+		sendJSONError(w, "Cannot move the root directory", http.StatusBadRequest)
+		return
+	}
+	if fromPath == toPath {
+		sendJSONError(w, "Source and destination are the same", http.StatusBadRequest)
+		return
+	}
+	if isWithin(toPath, fromPath) {
+		sendJSONError(w, "Cannot move a directory into itself", http.StatusBadRequest)
+		return
+	}
+	if isWithin(fromPath, toPath) {
+		sendJSONError(w, "Cannot move a path onto a directory containing it", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeWrite, fromPath, toPath) || !checkTreeAccess(w, r, permDelete, fromPath) || !checkAccess(w, r, permWrite, toPath) {
+		return
+	}
+
+	if _, err := storage.Stat(fromPath); err != nil {
+		if os.IsNotExist(err) {
+			sendJSONError(w, "Source not found", http.StatusNotFound)
+			return
+		}
+		sendJSONError(w, "Failed to access source", http.StatusInternalServerError)
+		return
+	}
+
+	if !checkOverwrite(w, r, reqBody.Conflict, toPath) {
+		return
+	}
+	toPath, status, err := resolveConflict(toPath, reqBody.Conflict)
+	if err != nil {
+		sendJSONError(w, err.Error(), status)
+		return
+	}
+
+	if err := storage.Mkdir(filepath.Dir(toPath), config.DirPerm); err != nil {
+		sendJSONError(w, "Failed to create directory", http.StatusInternalServerError)
+		return
+	}
+
+	if err := replacePath(r, fromPath, toPath); err != nil {
+		sendJSONError(w, "Failed to move", http.StatusInternalServerError)
+		return
+	}
+	moveSidecar(fromPath, toPath)
+
+	newPath := apiPath(r, toPath)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Moved '%s' to '%s'", reqBody.From, newPath),
+		"path":    newPath,
+	})
+}
+
+// checkOverwrite makes sure the request may delete a destination that the
+// overwrite policy would replace, sending a 403 if not
+func checkOverwrite(w http.ResponseWriter, r *http.Request, policy, fullPath string) bool {
+	if policy != conflictOverwrite {
+		return true
+	}
+	if _, err := storage.Stat(fullPath); err != nil {
+		return true
+	}
+	return checkScope(w, r, scopeDelete, fullPath) && checkTreeAccess(w, r, permDelete, fullPath)
+}
+
+// resolveConflict applies a conflict policy to a destination path. It returns
+// the path to write to, or an error with the HTTP status to report. With
+// overwrite an existing destination is left in place for replacePath.
+func resolveConflict(fullPath, policy string) (string, int, error) {
+	if _, err := storage.Stat(fullPath); err != nil {
+		if os.IsNotExist(err) {
+			return fullPath, 0, nil
+		}
+		return "", http.StatusInternalServerError, errors.New("Failed to access destination")
+	}
+
+	switch policy {
+	case conflictOverwrite:
+		return fullPath, 0, nil
+	case conflictAutorename:
+		unique, err := uniquePath(fullPath)
+		if err != nil {
+			return "", http.StatusConflict, errors.New("Failed to find a free name")
+		}
+		return unique, 0, nil
+	default:
+		return "", http.StatusConflict, errors.New("Destination already exists")
+	}
+}
+
+// replacePath moves src to target, replacing whatever is there. A file
+// replacing a file is renamed over it, keeping the old content as a version
+// if versioning is enabled. Anything else is moved aside first, into the
+// trash if it is enabled, so a failed rename puts it back and nothing is
+// lost before src is in place.
+func replacePath(r *http.Request, src, target string) error {
+	old, err := storage.Stat(target)
+	if os.IsNotExist(err) {
+		return storage.Rename(src, target)
+	}
+	if err != nil {
+		return err
+	}
+	info, err := storage.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() && !old.IsDir() && (versionsEnabled() || config.TrashRetention <= 0) {
+		undo, err := preserveVersion(target)
+		if err != nil {
+			return err
+		}
+		if err := storage.Rename(src, target); err != nil {
+			if undo != nil {
+				undo()
+			}
+			return err
+		}
+		return nil
+	}
+
+	var item *TrashItem
+	aside := filepath.Join(filepath.Dir(target), tempPrefix+randomID())
+	if config.TrashRetention > 0 {
+		if item, err = moveToTrash(r, target, old); err != nil {
+			return err
+		}
+		aside = item.dataPath()
+		item.keepSidecar(target)
+	} else if err := storage.Rename(target, aside); err != nil {
+		return err
+	}
+
+	if err := storage.Rename(src, target); err != nil {
+		if storage.Rename(aside, target) == nil && item != nil {
+			item.returnSidecar(target)
+			storage.Remove(item.infoPath())
+		}
+		return err
+	}
+	if item != nil {
+		logf(r, "Moved %s to the trash", item.Path)
+	} else {
+		storage.Remove(aside)
+	}
+	return nil
+}
+
+// maxUniqueNames is how many numbered names uniquePath tries
+const maxUniqueNames = 1000
+
+// uniquePath returns fullPath, or the first of "name (1).ext", "name (2).ext"
+// and so on that does not exist yet. It gives up on errors other than a
+// missing file, such as a name that is too long, and after maxUniqueNames
+// attempts.
+func uniquePath(fullPath string) (string, error) {
+	if _, err := storage.Stat(fullPath); err != nil {
+		if os.IsNotExist(err) {
+			return fullPath, nil
+		}
+		return "", err
+	}
+
+	dir, name := filepath.Split(fullPath)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i <= maxUniqueNames; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		if _, err := storage.Stat(candidate); err != nil {
+			if os.IsNotExist(err) {
+				return candidate, nil
+			}
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %s", fullPath)
+}
+
+// isWithin reports whether fullPath is dir itself or somewhere below it
+func isWithin(fullPath, dir string) bool {
+	rel, err := filepath.Rel(dir, fullPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
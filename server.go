@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Connection timeouts. There is no overall read or write timeout, since
+// uploads and downloads of large files may take hours.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// abortGrace is how long aborted requests and jobs get to clean up after the
+// shutdown timeout
+const abortGrace = 5 * time.Second
+
+// inFlight counts the requests being handled
+var inFlight atomic.Int64
+
+// trackRequests wraps a handler to count the requests in flight
+func trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the server until SIGINT or SIGTERM, then stops accepting
+// connections and gives running requests and background jobs up to the
+// shutdown timeout to finish. Whatever is still running after that is
+// aborted, and temp files left by aborted uploads are removed. A second
+// signal exits immediately.
+func serve(tlsConfig *tls.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{
+		Addr:              config.listenAddr(),
+		Handler:           trackRequests(http.DefaultServeMux),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	servers := []*http.Server{server}
+	errs := make(chan error, 2)
+	go func() {
+		if tlsConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	if tlsConfig != nil && config.HTTPRedirectPort != 0 {
+		redirect := &http.Server{
+			Addr:              fmt.Sprintf("%s:%d", config.Address, config.HTTPRedirectPort),
+			Handler:           http.HandlerFunc(redirectToHTTPS),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+		servers = append(servers, redirect)
+		log.Printf("Redirecting http://localhost:%d to HTTPS", config.HTTPRedirectPort)
+		go func() { errs <- redirect.ListenAndServe() }()
+	}
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutting down, waiting up to %s for %d requests and %d jobs (signal again to exit now)",
+		config.ShutdownTimeout, inFlight.Load(), runningJobs())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Shutdown closes the listeners at once and returns when every
+	// connection is idle
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("Shutdown: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	waitUntil(shutdownCtx, func() bool { return runningJobs() == 0 })
+
+	if shutdownCtx.Err() != nil {
+		log.Printf("Shutdown timeout reached, aborting %d requests and %d jobs", inFlight.Load(), runningJobs())
+		for _, s := range servers {
+			s.Close()
+		}
+		cancelAllJobs()
+
+		// Aborted handlers and jobs remove their partial files themselves
+		graceCtx, cancel := context.WithTimeout(context.Background(), abortGrace)
+		defer cancel()
+		waitUntil(graceCtx, func() bool { return inFlight.Load() == 0 && runningJobs() == 0 })
+	}
+
+	sweepTempFiles()
+	if shares != nil {
+		shares.flush()
+	}
+	log.Printf("Server stopped")
+}
+
+// waitUntil polls cond until it holds or ctx is done
+func waitUntil(ctx context.Context, cond func() bool) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
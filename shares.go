@@ -0,0 +1,742 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareBasePath is where public share links are served
+const shareBasePath = "/s/"
+
+// Share is a public link to a file or folder. The ID is the unguessable
+// part of the URL. An upload share is a drop box for a folder: anyone with
+// the link may add files to it but cannot see what is inside.
+type Share struct {
+	ID           string     `json:"id"`
+	Path         string     `json:"path"` // relative to the upload directory
+	IsDir        bool       `json:"is_dir"`
+	Owner        string     `json:"owner,omitempty"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	Created      time.Time  `json:"created"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int64      `json:"max_downloads,omitempty"`
+	Downloads    int64      `json:"downloads"`
+	Accesses     int64      `json:"accesses"`
+	Upload       bool       `json:"upload,omitempty"`
+	MaxFileSize  int64      `json:"max_file_size,omitempty"` // upload shares only, 0 for no limit
+	FileTypes    []string   `json:"file_types,omitempty"`    // upload shares only, e.g. ".pdf"
+	Uploads      int64      `json:"uploads,omitempty"`
+}
+
+// ShareStatus is the public view of a share
+type ShareStatus struct {
+	ID           string   `json:"id"`
+	URL          string   `json:"url"`
+	Path         string   `json:"path"`
+	IsDir        bool     `json:"is_dir"`
+	Owner        string   `json:"owner,omitempty"`
+	Protected    bool     `json:"protected"`
+	Created      string   `json:"created"`
+	Expires      string   `json:"expires,omitempty"`
+	MaxDownloads int64    `json:"max_downloads,omitempty"`
+	Downloads    int64    `json:"downloads"`
+	Accesses     int64    `json:"accesses"`
+	Upload       bool     `json:"upload,omitempty"`
+	MaxFileSize  int64    `json:"max_file_size,omitempty"`
+	FileTypes    []string `json:"file_types,omitempty"`
+	Uploads      int64    `json:"uploads,omitempty"`
+	Expired      bool     `json:"expired,omitempty"`
+}
+
+// shareStore holds the shares from the shares file, which only the server
+// writes. Access counts change on every request to a link, so they are only
+// kept in memory until the next flush.
+type shareStore struct {
+	mu     sync.Mutex
+	path   string
+	shares map[string]*Share
+	dirty  bool // counts changed since the file was last written
+}
+
+// shareFlushInterval is how often changed access counts are written to the
+// shares file
+const shareFlushInterval = time.Minute
+
+// shares is the share store, nil when sharing is not configured
+var shares *shareStore
+
+// loadShareStore reads the shares file. A missing file is an empty store.
+func loadShareStore(path string) (*shareStore, error) {
+	s := &shareStore{path: path, shares: make(map[string]*Share)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Shares []*Share `json:"shares"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, sh := range file.Shares {
+		s.shares[sh.ID] = sh
+	}
+	return s, nil
+}
+
+// save writes the store back to the shares file. s.mu must be held.
+func (s *shareStore) save() error {
+	list := make([]*Share, 0, len(s.shares))
+	for _, sh := range s.shares {
+		list = append(list, sh)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Created.Before(list[b].Created) })
+	if err := saveJSON(s.path, map[string]interface{}{"shares": list}); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// flush writes the store back if any counts changed since the last save
+func (s *shareStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Failed to save shares: %v", err)
+	}
+}
+
+// exhausted reports whether a share has expired or used up its downloads.
+// shares.mu must be held.
+func (sh *Share) exhausted() bool {
+	if sh.Expires != nil && time.Now().After(*sh.Expires) {
+		return true
+	}
+	return sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads
+}
+
+// Status returns the public view of a share, with its path as seen in v.
+// shares.mu must be held.
+func (sh *Share) Status(v *view) ShareStatus {
+	s := ShareStatus{
+		ID:           sh.ID,
+		URL:          shareBasePath + sh.ID,
+		Path:         sh.Path,
+		IsDir:        sh.IsDir,
+		Owner:        sh.Owner,
+		Protected:    sh.PasswordHash != "",
+		Created:      sh.Created.Format(config.TimeFormat),
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		Accesses:     sh.Accesses,
+		Upload:       sh.Upload,
+		MaxFileSize:  sh.MaxFileSize,
+		FileTypes:    sh.FileTypes,
+		Uploads:      sh.Uploads,
+		Expired:      sh.exhausted(),
+	}
+	if fullPath, err := rootView.resolve(sh.Path); err == nil {
+		s.Path = v.apiPath(fullPath)
+	}
+	if sh.Expires != nil {
+		s.Expires = sh.Expires.Format(config.TimeFormat)
+	}
+	return s
+}
+
+// handleAPIShares lists, creates and revokes share links
+func handleAPIShares(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if shares == nil {
+		sendJSONError(w, "Sharing is not enabled", http.StatusNotFound)
+		return
+	}
+	user := currentUser(r)
+
+	// Without accounts everyone manages every share
+	owns := func(sh *Share) bool {
+		return user == nil || user.Admin || sh.Owner == user.Name
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		shares.mu.Lock()
+		var mine []*Share
+		for _, sh := range shares.shares {
+			if owns(sh) {
+				mine = append(mine, sh)
+			}
+		}
+
+		// Newest first
+		sort.Slice(mine, func(a, b int) bool { return mine[a].Created.After(mine[b].Created) })
+		list := []ShareStatus{}
+		for _, sh := range mine {
+			list = append(list, sh.Status(requestView(r)))
+		}
+		shares.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"shares":  list,
+		})
+
+	case http.MethodPost:
+		handleCreateShare(w, r)
+
+	case http.MethodDelete:
+		if !checkScope(w, r, scopeShare) {
+			return
+		}
+		id := r.URL.Query().Get("id")
+
+		shares.mu.Lock()
+		defer shares.mu.Unlock()
+		sh := shares.shares[id]
+		if sh == nil || !owns(sh) {
+			sendJSONError(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		delete(shares.shares, id)
+		if err := shares.save(); err != nil {
+			shares.shares[id] = sh
+			sendJSONError(w, "Failed to revoke share", http.StatusInternalServerError)
+			return
+		}
+
+		logf(r, "Revoked share %s of %s", sh.ID, sh.Path)
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: "Share revoked",
+		})
+
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCreateShare creates a share link for a file or folder, or an upload
+// link for a folder
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		Path         string   `json:"path"`
+		Expires      string   `json:"expires"`
+		Password     string   `json:"password"`
+		MaxDownloads int64    `json:"max_downloads"`
+		Upload       bool     `json:"upload"`
+		MaxFileSize  int64    `json:"max_file_size"`
+		FileTypes    []string `json:"file_types"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, reqBody.Path)
+	if err != nil || reqBody.Path == "" {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeShare, fullPath) || !checkScope(w, r, scopeRead, fullPath) || !checkAccess(w, r, permShare, fullPath) {
+		return
+	}
+	if reqBody.Upload && (!checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath)) {
+		return
+	}
+
+	info, err := storage.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendJSONError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		sendJSONError(w, "Failed to access file", http.StatusInternalServerError)
+		return
+	}
+
+	if reqBody.MaxDownloads < 0 || reqBody.MaxFileSize < 0 {
+		sendJSONError(w, "Limits must not be negative", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Upload && !info.IsDir() {
+		sendJSONError(w, "Upload links must point to a directory", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Upload && reqBody.MaxDownloads > 0 {
+		sendJSONError(w, "Upload links have no downloads to limit", http.StatusBadRequest)
+		return
+	}
+	if !reqBody.Upload && (reqBody.MaxFileSize > 0 || len(reqBody.FileTypes) > 0) {
+		sendJSONError(w, "File size and type limits only apply to upload links", http.StatusBadRequest)
+		return
+	}
+	fileTypes, err := parseFileTypes(reqBody.FileTypes)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expires, err := parseExpiry(reqBody.Expires)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sh := &Share{
+		ID:           randomID(),
+		Path:         rootView.apiPath(fullPath),
+		IsDir:        info.IsDir(),
+		Created:      time.Now(),
+		Expires:      expires,
+		MaxDownloads: reqBody.MaxDownloads,
+		Upload:       reqBody.Upload,
+		MaxFileSize:  reqBody.MaxFileSize,
+		FileTypes:    fileTypes,
+	}
+	if user := currentUser(r); user != nil {
+		sh.Owner = user.Name
+	}
+	if reqBody.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), bcrypt.DefaultCost)
+		if err != nil {
+			sendJSONError(w, "Failed to create share", http.StatusInternalServerError)
+			return
+		}
+		sh.PasswordHash = string(hash)
+	}
+
+	shares.mu.Lock()
+	defer shares.mu.Unlock()
+	shares.shares[sh.ID] = sh
+	if err := shares.save(); err != nil {
+		delete(shares.shares, sh.ID)
+		sendJSONError(w, "Failed to save share", http.StatusInternalServerError)
+		return
+	}
+
+	logf(r, "Shared %s as %s", sh.Path, sh.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Share created",
+		"share":   sh.Status(requestView(r)),
+	})
+}
+
+// ownerFilter returns a filter that passes the paths the owner of a share
+// still has perm on, or nil if nothing needs to be filtered. Listing counts
+// as allowed wherever the owner could browse. A share whose owner no longer
+// exists passes nothing.
+func (sh *Share) ownerFilter(perm string) func(fullPath string) bool {
+	if users == nil || sh.Owner == "" {
+		return nil
+	}
+	owner := users.get(sh.Owner)
+	if owner == nil {
+		return func(string) bool { return false }
+	}
+	if acl == nil || owner.Admin {
+		return nil
+	}
+	return func(fullPath string) bool {
+		if perm == permList {
+			return acl.visible(owner, fullPath)
+		}
+		return acl.allowed(owner, perm, fullPath)
+	}
+}
+
+// shareCookie returns the cookie name and the value proving the password
+// of a share was given. The value is derived from the password hash, so it
+// stops working when the share is revoked. The name is derived from the ID,
+// which may have any length in a hand-edited shares file.
+func shareCookie(sh *Share) (string, string) {
+	return "gofs_share_" + hashToken(sh.ID)[:16], hashToken(sh.ID + sh.PasswordHash)
+}
+
+// handleShare serves a share link to anyone who has it: a file is downloaded
+// directly, a folder can be browsed read-only and downloaded as an archive.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	if shares == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, subPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, shareBasePath), "/")
+
+	// Every access is counted and logged, the rest works on a copy
+	shares.mu.Lock()
+	sh := shares.shares[id]
+	var snapshot Share
+	if sh != nil {
+		sh.Accesses++
+		shares.dirty = true
+		snapshot = *sh
+	}
+	exhausted := sh != nil && sh.exhausted()
+	shares.mu.Unlock()
+
+	if sh == nil {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Share %s (%s): %s %s from %s", sh.ID, snapshot.Path, r.Method, r.URL.RequestURI(), r.RemoteAddr)
+
+	if exhausted {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+
+	// Password protected shares ask once per browser, or take the password
+	// as HTTP Basic credentials with any user name
+	if snapshot.PasswordHash != "" {
+		name, value := shareCookie(&snapshot)
+		cookie, err := r.Cookie(name)
+		authorized := err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(value)) == 1
+		if _, password, ok := r.BasicAuth(); ok && !authorized {
+			authorized = bcrypt.CompareHashAndPassword([]byte(snapshot.PasswordHash), []byte(password)) == nil
+		}
+
+		// Only the password form is read here, an upload to a drop box is
+		// refused below until the password has been given
+		passwordForm := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+		if !authorized && r.Method == http.MethodPost && passwordForm {
+			if bcrypt.CompareHashAndPassword([]byte(snapshot.PasswordHash), []byte(r.PostFormValue("password"))) == nil {
+				http.SetCookie(w, &http.Cookie{
+					Name:     name,
+					Value:    value,
+					Path:     shareBasePath + sh.ID,
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+				http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+				return
+			}
+			log.Printf("Share %s: wrong password from %s", sh.ID, r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			renderShare(w, map[string]interface{}{"PasswordRequired": true, "PasswordError": true})
+			return
+		}
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			renderShare(w, map[string]interface{}{"PasswordRequired": true})
+			return
+		}
+	}
+
+	root, err := rootView.resolve(snapshot.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if snapshot.Upload {
+		if subPath != "" {
+			http.NotFound(w, r)
+			return
+		}
+		handleDropBox(w, r, sh, &snapshot, root)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !snapshot.IsDir {
+		if canRead := snapshot.ownerFilter(permRead); subPath != "" || canRead != nil && !canRead(root) {
+			http.NotFound(w, r)
+			return
+		}
+		serveShareFile(w, r, sh, root)
+		return
+	}
+
+	// Inside a folder share, paths resolve against the shared folder
+	shareView := &view{mounts: []mountPoint{{"/", root}}}
+	fullPath, err := shareView.resolve(subPath)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	info, err := storage.Stat(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A share shows no more than its owner may see
+	canRead, canList := snapshot.ownerFilter(permRead), snapshot.ownerFilter(permList)
+	allowed := canRead
+	if info.IsDir() {
+		allowed = canList
+	}
+	if allowed != nil && !allowed(fullPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		if !countShareDownload(sh) {
+			http.Error(w, "This link has expired", http.StatusGone)
+			return
+		}
+		name := info.Name()
+		streamArchive(w, format, name, []archiveRoot{{fullPath, name}}, canRead)
+		return
+	}
+
+	if !info.IsDir() {
+		serveShareFile(w, r, sh, fullPath)
+		return
+	}
+
+	// Folders are listed with links relative to the share
+	entries, err := storage.List(fullPath)
+	if err != nil {
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	dirPath := shareView.apiPath(fullPath)
+	base := shareBasePath + sh.ID
+	var files []map[string]interface{}
+	for _, info := range entries {
+		if isInternalName(info.Name()) || canList != nil && !canList(filepath.Join(fullPath, info.Name())) {
+			continue
+		}
+		link := base + path.Join(dirPath, info.Name())
+		if info.IsDir() {
+			link += "/"
+		}
+		files = append(files, map[string]interface{}{
+			"Name":      info.Name(),
+			"Link":      link,
+			"IsDir":     info.IsDir(),
+			"Size":      info.Size(),
+			"UpdatedAt": info.ModTime().Format(config.TimeFormat),
+		})
+	}
+
+	var parent string
+	if dirPath != "/" {
+		parent = base + path.Dir(dirPath)
+		if !strings.HasSuffix(parent, "/") {
+			parent += "/"
+		}
+	}
+	renderShare(w, map[string]interface{}{
+		"Name":    filepath.Base(root),
+		"Path":    dirPath,
+		"Parent":  parent,
+		"Archive": base + dirPath + "?format=zip",
+		"Files":   files,
+	})
+}
+
+// serveShareFile sends a file from a share, counting it as a download unless
+// it only continues an earlier one
+func serveShareFile(w http.ResponseWriter, r *http.Request, sh *Share, fullPath string) {
+	if r.Method == http.MethodGet && !continuesDownload(r, fullPath) && !countShareDownload(sh) {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(fullPath)))
+	setFileDigests(w, fullPath)
+	serveStored(w, r, fullPath)
+}
+
+// continuesDownload reports whether a request only asks for a range that
+// starts past the beginning of the file. Any request for the first byte
+// counts as a new download, however it is split up.
+func continuesDownload(r *http.Request, fullPath string) bool {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return false
+	}
+	info, err := storage.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(spec, ",") {
+		first, last, _ := strings.Cut(strings.TrimSpace(part), "-")
+		var start int64
+		if first == "" {
+			// A suffix range: the last bytes of the file
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				return false
+			}
+			start = info.Size() - n
+		} else if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return false
+		}
+		if start <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// countShareDownload takes one download from a share's allowance, reporting
+// false if none is left
+func countShareDownload(sh *Share) bool {
+	shares.mu.Lock()
+	defer shares.mu.Unlock()
+	if sh.exhausted() {
+		return false
+	}
+	sh.Downloads++
+	shares.dirty = true
+
+	// A used up link must stay used up even if the server stops before the
+	// next flush
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		if err := shares.save(); err != nil {
+			log.Printf("Failed to save shares: %v", err)
+		}
+	}
+	return true
+}
+
+// countShareUpload records a file received through an upload share
+func countShareUpload(sh *Share) {
+	shares.mu.Lock()
+	defer shares.mu.Unlock()
+	sh.Uploads++
+	shares.dirty = true
+}
+
+// renderShare renders the page shown for folder shares, upload shares and
+// password prompts
+func renderShare(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl := template.Must(template.New("share").Parse(shareHTML))
+	tmpl.Execute(w, data)
+}
+
+// HTML template for shared folders and the share password prompt
+const shareHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{if .PasswordRequired}}Protected link{{else if .Upload}}Send files{{else}}{{.Name}}{{end}}</title>
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 900px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        .container {
+            background-color: #f9f9f9;
+            border-radius: 5px;
+            padding: 20px;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+        }
+        .file-item {
+            display: flex;
+            padding: 10px 15px;
+            border-bottom: 1px solid #eee;
+        }
+        .file-item .name {
+            flex-grow: 1;
+        }
+        .file-item .meta {
+            color: #777;
+            font-size: 0.9em;
+        }
+        a {
+            color: #2196F3;
+            text-decoration: none;
+        }
+        .error {
+            color: #c0392b;
+        }
+        .hint {
+            color: #777;
+            font-size: 0.9em;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+    {{if .PasswordRequired}}
+        <h3>This link is password protected</h3>
+        {{if .PasswordError}}<p class="error">Wrong password</p>{{end}}
+        <form method="POST">
+            <input type="password" name="password" placeholder="Password" autofocus required>
+            <button type="submit">Open</button>
+        </form>
+    {{else if .Upload}}
+        <h3>Send files to {{.Name}}</h3>
+        <p class="hint">
+            Files are delivered privately, nothing uploaded here can be seen through this page.
+            {{if .MaxFileSize}}Up to {{.MaxFileSize}} per file.{{end}}
+            {{if .FileTypes}}Allowed types: {{.FileTypes}}.{{end}}
+        </p>
+        <form id="uploadForm" method="POST" enctype="multipart/form-data">
+            <input type="file" name="file" multiple required>
+            <button type="submit">Upload</button>
+        </form>
+        <p id="uploadResult"></p>
+        <script>
+            // Send the files in the background and report each one
+            document.getElementById('uploadForm').addEventListener('submit', function(event) {
+                event.preventDefault();
+                const form = event.target;
+                const result = document.getElementById('uploadResult');
+                result.textContent = 'Uploading...';
+                fetch(window.location.pathname, { method: 'POST', body: new FormData(form) })
+                    .then(response => response.json())
+                    .then(data => {
+                        const lines = (data.files || []).map(f => f.name + ': ' + (f.success ? 'received' : f.error));
+                        result.innerText = lines.length ? lines.join('\n') : data.error;
+                        form.reset();
+                    })
+                    .catch(() => { result.textContent = 'Upload failed, please try again.'; });
+            });
+        </script>
+    {{else}}
+        <h3>{{.Name}}{{if ne .Path "/"}} &ndash; {{.Path}}{{end}}</h3>
+        <p>
+            {{if .Parent}}<a href="{{.Parent}}">&uarr; Up</a> &middot; {{end}}
+            <a href="{{.Archive}}">Download all as ZIP</a>
+        </p>
+        {{range .Files}}
+        <div class="file-item">
+            <span class="name"><a href="{{.Link}}">{{if .IsDir}}&#128193;{{else}}&#128196;{{end}} {{.Name}}</a></span>
+            <span class="meta">{{if not .IsDir}}{{.Size}} bytes &middot; {{end}}{{.UpdatedAt}}</span>
+        </div>
+        {{else}}
+        <p>This folder is empty.</p>
+        {{end}}
+    {{end}}
+    </div>
+</body>
+</html>
+`
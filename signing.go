@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SigningKey is a secret used to sign URLs. The newest key signs new URLs,
+// every key in the file is accepted when verifying, so keys can be rotated
+// without breaking links that are already out.
+type SigningKey struct {
+	ID      string    `json:"id"`
+	Secret  string    `json:"secret"` // hex encoded
+	Created time.Time `json:"created"`
+}
+
+// signingKeyStore holds the keys from the signing keys file, reloading it
+// when the file changes like the user store does
+type signingKeyStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	keys    []*SigningKey // oldest first
+}
+
+// signingKeys is the key store, nil when signed URLs are not configured
+var signingKeys *signingKeyStore
+
+// loadSigningKeys reads the signing keys file. A missing file is an empty
+// store.
+func loadSigningKeys(path string) (*signingKeyStore, error) {
+	s := &signingKeyStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the keys file if it changed since the last read.
+// s.mu must be held, or s not yet shared.
+func (s *signingKeyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys = nil
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Keys []*SigningKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	for _, k := range file.Keys {
+		if k.ID == "" || len(k.Secret) < 32 {
+			return fmt.Errorf("%s: key %q is invalid", s.path, k.ID)
+		}
+	}
+	sort.SliceStable(file.Keys, func(a, b int) bool { return file.Keys[a].Created.Before(file.Keys[b].Created) })
+
+	s.keys = file.Keys
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the store back to the keys file. s.mu must be held.
+func (s *signingKeyStore) save() error {
+	return saveJSON(s.path, map[string]interface{}{"keys": s.keys})
+}
+
+// rotate adds a new key, which signs every URL from then on. s.mu must be
+// held.
+func (s *signingKeyStore) rotate() (*SigningKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	k := &SigningKey{
+		ID:      randomID()[:8],
+		Secret:  hex.EncodeToString(secret),
+		Created: time.Now(),
+	}
+	s.keys = append(s.keys, k)
+	if err := s.save(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return nil, err
+	}
+	return k, nil
+}
+
+// current returns the key to sign with and a lookup of all keys by ID,
+// picking up changes to the keys file
+func (s *signingKeyStore) current() (*SigningKey, map[string]*SigningKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		log.Printf("Failed to reload signing keys, keeping previous keys: %v", err)
+	}
+
+	byID := make(map[string]*SigningKey, len(s.keys))
+	for _, k := range s.keys {
+		byID[k.ID] = k
+	}
+	if len(s.keys) == 0 {
+		return nil, byID
+	}
+	return s.keys[len(s.keys)-1], byID
+}
+
+// signature returns the hex HMAC-SHA256 of a method, URL path and query,
+// the query being every parameter but the signature in canonical order.
+// Parameters such as format or version change what a URL serves, so none
+// can be added to a signed URL.
+func (k *SigningKey) signature(method, urlPath string, query url.Values) string {
+	unsigned := url.Values{}
+	for name, values := range query {
+		if name != "sig" {
+			unsigned[name] = values
+		}
+	}
+	secret, _ := hex.DecodeString(k.Secret)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, urlPath, unsigned.Encode())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL returns urlPath with the query parameters that allow method on it
+// until expires, without any other authentication
+func signURL(method, urlPath string, expires time.Time) (string, error) {
+	key, _ := signingKeys.current()
+	if key == nil {
+		return "", errors.New("no signing key configured")
+	}
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("kid", key.ID)
+	query.Set("sig", key.signature(method, urlPath, query))
+	return (&url.URL{Path: urlPath}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+var errSignatureInvalid = errors.New("Invalid or expired signature")
+
+// verifySignedURL checks the signature of a request made with a signed URL,
+// returning the key that signed it
+func verifySignedURL(r *http.Request) (*SigningKey, error) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, errSignatureInvalid
+	}
+
+	_, keys := signingKeys.current()
+	key := keys[query.Get("kid")]
+	if key == nil {
+		return nil, errSignatureInvalid
+	}
+	want := key.signature(r.Method, r.URL.Path, query)
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(want)) {
+		return nil, errSignatureInvalid
+	}
+	return key, nil
+}
+
+// handleAPISign mints a signed URL to download or upload one path. The URL
+// carries the caller's access to anyone who has it, so sharing permission is
+// needed as well.
+func handleAPISign(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if signingKeys == nil {
+		sendJSONError(w, "Signed URLs are not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		Path   string `json:"path"`
+		Method string `json:"method"`
+		TTL    string `json:"ttl"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	ttl := config.SignedURLMaxTTL
+	if reqBody.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(reqBody.TTL); err != nil || ttl <= 0 {
+			sendJSONError(w, "TTL must be a positive duration, e.g. 24h", http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > config.SignedURLMaxTTL {
+		sendJSONError(w, fmt.Sprintf("TTL must not exceed %s", config.SignedURLMaxTTL), http.StatusBadRequest)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, reqBody.Path)
+	if err != nil || reqBody.Path == "" {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeShare, fullPath) {
+		return
+	}
+
+	// Signed requests carry no user, so the URL uses the path below the
+	// upload directory
+	var method, urlPath string
+	switch reqBody.Method {
+	case "", "download":
+		if !checkScope(w, r, scopeRead, fullPath) || !checkAccess(w, r, permRead, fullPath) || !checkAccess(w, r, permShare, fullPath) {
+			return
+		}
+		if _, err := storage.Stat(fullPath); err != nil {
+			sendJSONError(w, "File not found", http.StatusNotFound)
+			return
+		}
+		method, urlPath = http.MethodGet, "/download"+rootView.apiPath(fullPath)
+	case "upload":
+		if isRoot(r, fullPath) {
+			sendJSONError(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		if !checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath) || !checkAccess(w, r, permShare, fullPath) {
+			return
+		}
+		method, urlPath = http.MethodPut, "/api/upload"+rootView.apiPath(fullPath)
+	default:
+		sendJSONError(w, "Method must be download or upload", http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(ttl)
+	signed, err := signURL(method, urlPath, expires)
+	if err != nil {
+		sendJSONError(w, "Failed to sign URL", http.StatusInternalServerError)
+		return
+	}
+
+	logf(r, "Signed %s %s until %s", method, urlPath, expires.Format(time.RFC3339))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"method":  method,
+		"url":     signed,
+		"expires": expires.Format(config.TimeFormat),
+	})
+}
+
+// runKeysCommand manages the signing keys file from the command line:
+//
+//	keys list            list keys, newest last
+//	keys rotate          add a key that signs new URLs from now on
+//	keys remove <id>     retire a key, invalidating the URLs it signed
+func runKeysCommand(args []string) error {
+	if config.SigningKeysFile == "" {
+		return errors.New("signing-keys-file is not configured")
+	}
+	store, err := loadSigningKeys(config.SigningKeysFile)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	usage := errors.New("usage: keys list | keys rotate | keys remove <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for i, k := range store.keys {
+			note := ""
+			if i == len(store.keys)-1 {
+				note = " (signing)"
+			}
+			fmt.Printf("%s  created %s%s\n", k.ID, k.Created.Format(config.TimeFormat), note)
+		}
+		return nil
+
+	case args[0] == "rotate" && len(args) == 1:
+		k, err := store.rotate()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added key %s, new URLs are signed with it\n", k.ID)
+		return nil
+
+	case args[0] == "remove" && len(args) == 2:
+		for i, k := range store.keys {
+			if k.ID == args[1] {
+				store.keys = append(store.keys[:i], store.keys[i+1:]...)
+				return store.save()
+			}
+		}
+		return fmt.Errorf("no key %q", args[1])
+
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage holds the files below the upload directory. Every handler reaches
+// them through it, with names being the full paths that view.resolve
+// returns, so a backend only has to map those onto whatever it keeps the
+// data in. Errors for missing files must satisfy os.IsNotExist.
+type Storage interface {
+	// Stat describes a file or directory
+	Stat(name string) (fs.FileInfo, error)
+	// List describes the entries of a directory, sorted by name
+	List(dir string) ([]fs.FileInfo, error)
+	// Open opens a file for reading. It can seek, which serves ranges.
+	Open(name string) (StoredFile, error)
+	// Create starts a new file in dir that only appears once committed. It
+	// gets perm as its permissions.
+	Create(dir string, perm fs.FileMode) (PendingFile, error)
+	// Mkdir creates a directory along with any missing parents
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes a file, or a directory with everything in it. A name
+	// that does not exist is not an error.
+	Remove(name string) error
+	// Rename moves a file or directory, replacing a file at newName
+	Rename(oldName, newName string) error
+	// Chtimes sets the modification time of a file or directory
+	Chtimes(name string, mtime time.Time) error
+}
+
+// StoredFile is an open file of a Storage
+type StoredFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// PendingFile is a file being written that is not visible yet
+type PendingFile interface {
+	io.Writer
+	// Commit gives the file its name. An existing file is replaced if
+	// replace is set, otherwise Commit fails with an error satisfying
+	// os.IsExist and may be retried with another name.
+	Commit(name string, replace bool) error
+	// Abort discards the file. It does nothing once the file is committed.
+	Abort()
+}
+
+// Linker is implemented by storages that can give a file a second name
+// without copying it. Link fails with an error satisfying os.IsExist if
+// newName is taken.
+type Linker interface {
+	Link(oldName, newName string) error
+}
+
+// storageBackends creates the storage for each value of the storage
+// setting. Another backend only needs to add itself here.
+var storageBackends = map[string]func(c *Config) (Storage, error){
+	"local":  newLocalStorage,
+	"memory": newMemoryStorage,
+}
+
+// storage holds the files, set once at startup
+var storage Storage
+
+// storageNames returns the known storage backends in order
+func storageNames() []string {
+	var names []string
+	for name := range storageBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readStored returns the content of a stored file
+func readStored(name string) ([]byte, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// saveStored replaces a stored file with v encoded as indented JSON, like
+// saveJSON does for the files outside the storage
+func saveStored(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	pending, err := storage.Create(filepath.Dir(name), 0600)
+	if err != nil {
+		return err
+	}
+	defer pending.Abort()
+	if _, err := pending.Write(data); err != nil {
+		return err
+	}
+	return pending.Commit(name, true)
+}
+
+// linkStored gives a stored file a second name, copying it with perm where
+// the storage cannot link. It fails if newName exists.
+func linkStored(oldName, newName string, perm fs.FileMode) error {
+	if l, ok := storage.(Linker); ok {
+		// Mounts may be on another file system, so a copy is still tried
+		if err := l.Link(oldName, newName); err == nil || os.IsExist(err) {
+			return err
+		}
+	}
+
+	src, err := storage.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	pending, err := storage.Create(filepath.Dir(newName), perm)
+	if err != nil {
+		return err
+	}
+	defer pending.Abort()
+	if _, err := io.Copy(pending, src); err != nil {
+		return err
+	}
+	return pending.Commit(newName, false)
+}
+
+// fileAdopter is implemented by storages that can take over a finished
+// stored file as a pending file without copying it
+type fileAdopter interface {
+	adoptFile(name string, perm fs.FileMode) (PendingFile, error)
+}
+
+// joinStored returns a pending file in dir with perm as its permissions that
+// holds the content of the named stored files one after another, which is
+// also written to w as it is read. A single file is taken over where the
+// storage can, so it is gone once the pending file is committed; otherwise
+// the files are left for the caller to remove.
+func joinStored(names []string, dir string, perm fs.FileMode, w io.Writer) (PendingFile, error) {
+	if a, ok := storage.(fileAdopter); ok && len(names) == 1 {
+		f, err := storage.Open(names[0])
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return a.adoptFile(names[0], perm)
+	}
+
+	pending, err := storage.Create(dir, perm)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		f, err := storage.Open(name)
+		if err != nil {
+			pending.Abort()
+			return nil, err
+		}
+		_, err = io.Copy(io.MultiWriter(pending, w), f)
+		f.Close()
+		if err != nil {
+			pending.Abort()
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// walkStorage calls fn for root and everything below it, directories in name
+// order, like filepath.Walk does on disk. fn may return filepath.SkipDir to
+// leave out a directory.
+func walkStorage(root string, fn filepath.WalkFunc) error {
+	info, err := storage.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkStored(root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkStored walks below a directory for walkStorage
+func walkStored(name string, info fs.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+
+	entries, err := storage.List(name)
+	err1 := fn(name, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, entry := range entries {
+		err := walkStored(filepath.Join(name, entry.Name()), entry, fn)
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveStored sends a stored file, answering range and conditional requests.
+// A directory is sent as a plain list of links.
+func serveStored(w http.ResponseWriter, r *http.Request, fullPath string) {
+	info, err := storage.Stat(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if info.IsDir() {
+		// Relative links need the trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		entries, err := storage.List(fullPath)
+		if err != nil {
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+		for _, e := range entries {
+			if isInternalName(e.Name()) {
+				continue
+			}
+			name := e.Name()
+			if e.IsDir() {
+				name += "/"
+			}
+			link := url.URL{Path: name}
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(name))
+		}
+		fmt.Fprintf(w, "</pre>\n")
+		return
+	}
+
+	f, err := storage.Open(fullPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// localStorage keeps the files in the upload directory on disk. Names are
+// used as they are, since resolved paths are real paths already.
+type localStorage struct{}
+
+func newLocalStorage(c *Config) (Storage, error) {
+	return localStorage{}, nil
+}
+
+// Stat follows symbolic links, but still describes a link whose target is
+// gone so it can be deleted
+func (localStorage) Stat(name string) (fs.FileInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		if linkInfo, lerr := os.Lstat(name); lerr == nil {
+			return linkInfo, nil
+		}
+	}
+	return info, err
+}
+
+func (localStorage) List(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		// Entries removed since reading the directory are left out
+		if info, err := e.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (localStorage) Open(name string) (StoredFile, error) {
+	return os.Open(name)
+}
+
+// Create writes to a hidden temp file in dir, so a failed write never
+// replaces or truncates an existing file
+func (localStorage) Create(dir string, perm fs.FileMode) (PendingFile, error) {
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &localPending{f: f, name: f.Name(), perm: perm}, nil
+}
+
+func (localStorage) Mkdir(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (localStorage) Remove(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (localStorage) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (localStorage) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(name, mtime, mtime)
+}
+
+func (localStorage) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+// adoptFile takes over a finished file as a pending file, without copying
+// it. The file stays where it is if the pending file is aborted.
+func (localStorage) adoptFile(name string, perm fs.FileMode) (PendingFile, error) {
+	return &localPending{name: name, perm: perm, adopted: true}, nil
+}
+
+// localPending is a temp file that is renamed or linked into place
+type localPending struct {
+	f       *os.File // nil once closed
+	name    string
+	perm    fs.FileMode
+	adopted bool
+	done    bool
+}
+
+func (p *localPending) Write(b []byte) (int, error) {
+	return p.f.Write(b)
+}
+
+// finish makes the file readable like any uploaded file, flushes it to disk
+// and closes it
+func (p *localPending) finish() error {
+	if p.f == nil {
+		return os.Chmod(p.name, p.perm)
+	}
+	f := p.f
+	p.f = nil
+	if err := f.Chmod(p.perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Commit renames the file over name when replacing, and otherwise hard
+// links it, which fails rather than replaces when name is taken
+func (p *localPending) Commit(name string, replace bool) error {
+	if err := p.finish(); err != nil {
+		return err
+	}
+	if replace {
+		if err := os.Rename(p.name, name); err != nil {
+			return err
+		}
+	} else if err := os.Link(p.name, name); err == nil {
+		os.Remove(p.name)
+	} else if os.IsExist(err) {
+		return err
+	} else if err := p.claim(name); err != nil {
+		return err
+	}
+	p.done = true
+	return nil
+}
+
+// claim is Commit without replacing for file systems that have no hard
+// links: name is created exclusively first, so a file that is there already
+// is kept, and then replaced by the renamed file
+func (p *localPending) claim(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, p.perm)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Rename(p.name, name); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func (p *localPending) Abort() {
+	if p.f != nil {
+		p.f.Close()
+		p.f = nil
+	}
+	if !p.done && !p.adopted {
+		os.Remove(p.name)
+	}
+	p.done = true
+}
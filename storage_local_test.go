@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// claim stands in for the hard link on file systems that have none
+func TestLocalClaimWithoutLinks(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "taken.txt")
+	if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := localStorage{}.Create(dir, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Abort()
+	if _, err := pending.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	p := pending.(*localPending)
+	if err := p.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.claim(existing); !os.IsExist(err) {
+		t.Fatalf("claiming a taken name: %v, want an existence error", err)
+	}
+	if data, _ := os.ReadFile(existing); string(data) != "old" {
+		t.Errorf("taken name holds %q, want %q", data, "old")
+	}
+
+	free := filepath.Join(dir, "free.txt")
+	if err := p.claim(free); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(free); string(data) != "new" {
+		t.Errorf("claimed name holds %q, want %q", data, "new")
+	}
+	if _, err := os.Stat(p.name); !os.IsNotExist(err) {
+		t.Errorf("temp file is still there: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps the files in memory, for tests and scratch instances.
+// Everything is lost when the server stops. Content is never changed in
+// place, so linked names can share it.
+type memoryStorage struct {
+	mu   sync.RWMutex
+	root string   // the upload directory, which always exists
+	top  *memNode // the node of root
+}
+
+// memNode is a file or directory of a memoryStorage
+type memNode struct {
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte              // file content
+	children map[string]*memNode // directory entries, nil for files
+}
+
+var (
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+func newMemoryStorage(c *Config) (Storage, error) {
+	return &memoryStorage{
+		root: filepath.Clean(c.UploadPath),
+		top:  &memNode{mode: fs.ModeDir | c.DirPerm, modTime: time.Now(), children: map[string]*memNode{}},
+	}, nil
+}
+
+// lookup finds the node of a name, or nil
+func (s *memoryStorage) lookup(name string) *memNode {
+	rel, err := filepath.Rel(s.root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	node := s.top
+	if rel == "." {
+		return node
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if node.children == nil {
+			return nil
+		}
+		if node = node.children[part]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// parent finds the directory a name is created in
+func (s *memoryStorage) parent(op, name string) (*memNode, string, error) {
+	dir := s.lookup(filepath.Dir(name))
+	if dir == nil || name == s.root {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if dir.children == nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return dir, filepath.Base(name), nil
+}
+
+func (s *memoryStorage) Stat(name string) (fs.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node := s.lookup(name)
+	if node == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (s *memoryStorage) List(dir string) ([]fs.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node := s.lookup(dir)
+	if node == nil {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+	}
+	if node.children == nil {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: errNotDir}
+	}
+	infos := make([]fs.FileInfo, 0, len(node.children))
+	for name, child := range node.children {
+		infos = append(infos, child.info(name))
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Name() < infos[b].Name() })
+	return infos, nil
+}
+
+func (s *memoryStorage) Open(name string) (StoredFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	node := s.lookup(name)
+	if node == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.children != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	return memFile{bytes.NewReader(node.data)}, nil
+}
+
+func (s *memoryStorage) Create(dir string, perm fs.FileMode) (PendingFile, error) {
+	if info, err := s.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, &fs.PathError{Op: "create", Path: dir, Err: errNotDir}
+	}
+	return &memPending{s: s, perm: perm}, nil
+}
+
+func (s *memoryStorage) Mkdir(name string, perm fs.FileMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mkdirLocked(name, perm)
+}
+
+// mkdirLocked is Mkdir with the lock held
+func (s *memoryStorage) mkdirLocked(name string, perm fs.FileMode) error {
+	if node := s.lookup(name); node != nil {
+		if node.children == nil {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+	if filepath.Dir(name) == name {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if err := s.mkdirLocked(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	dir, base, err := s.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	dir.put(base, &memNode{mode: fs.ModeDir | perm, modTime: time.Now(), children: map[string]*memNode{}})
+	return nil
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookup(name) == nil {
+		return nil
+	}
+	dir, base, err := s.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	dir.put(base, nil)
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := s.lookup(oldName)
+	if node == nil || oldName == s.root {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if filepath.Clean(oldName) == filepath.Clean(newName) {
+		return nil
+	}
+	if isWithin(newName, oldName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+	}
+	dir, base, err := s.parent("rename", newName)
+	if err != nil {
+		return err
+	}
+	if existing := dir.children[base]; existing != nil {
+		switch {
+		case existing.children != nil && node.children == nil:
+			return &fs.PathError{Op: "rename", Path: newName, Err: errIsDir}
+		case existing.children == nil && node.children != nil:
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotDir}
+		case len(existing.children) > 0:
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotEmpty}
+		}
+	}
+	oldDir, oldBase, err := s.parent("rename", oldName)
+	if err != nil {
+		return err
+	}
+	oldDir.put(oldBase, nil)
+	dir.put(base, node)
+	return nil
+}
+
+func (s *memoryStorage) Chtimes(name string, mtime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := s.lookup(name)
+	if node == nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// Link adds a name sharing the content of a file
+func (s *memoryStorage) Link(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := s.lookup(oldName)
+	if node == nil {
+		return &fs.PathError{Op: "link", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if node.children != nil {
+		return &fs.PathError{Op: "link", Path: oldName, Err: errIsDir}
+	}
+	linked := *node
+	return s.add("link", newName, &linked, false)
+}
+
+// add puts a file node at name, replacing a file there if replace is set
+func (s *memoryStorage) add(op, name string, node *memNode, replace bool) error {
+	dir, base, err := s.parent(op, name)
+	if err != nil {
+		return err
+	}
+	if existing := dir.children[base]; existing != nil {
+		if !replace {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+		}
+		if existing.children != nil {
+			return &fs.PathError{Op: op, Path: name, Err: errIsDir}
+		}
+	}
+	dir.put(base, node)
+	return nil
+}
+
+// put sets or, with a nil node, removes an entry of a directory, which
+// changes its modification time
+func (n *memNode) put(name string, child *memNode) {
+	if child == nil {
+		delete(n.children, name)
+	} else {
+		n.children[name] = child
+	}
+	n.modTime = time.Now()
+}
+
+// info describes a node under a name
+func (n *memNode) info(name string) fs.FileInfo {
+	return memInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memInfo describes a file or directory of a memoryStorage
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() interface{}   { return nil }
+
+// memFile reads the content of a file as it was when opened
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+// memPending collects a file in memory until it is committed
+type memPending struct {
+	s    *memoryStorage
+	buf  bytes.Buffer
+	perm fs.FileMode
+	done bool
+}
+
+func (p *memPending) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+func (p *memPending) Commit(name string, replace bool) error {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	node := &memNode{mode: p.perm, modTime: time.Now(), data: p.buf.Bytes()}
+	if err := p.s.add("commit", name, node, replace); err != nil {
+		return err
+	}
+	p.done = true
+	return nil
+}
+
+func (p *memPending) Abort() {
+	if !p.done {
+		p.buf = bytes.Buffer{}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The handlers run against a memoryStorage here, so they are exercised end
+// to end without touching the disk.
+
+const testUploadPath = "/uploads"
+
+// useMemoryStorage gives a test the default configuration and an empty
+// memory storage, restoring the previous ones when it ends
+func useMemoryStorage(t *testing.T) {
+	t.Helper()
+	oldConfig, oldStorage := config, storage
+	t.Cleanup(func() { config, storage = oldConfig, oldStorage })
+
+	config = defaultConfig()
+	config.UploadPath = testUploadPath
+	config.Storage = "memory"
+	s, err := newMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = s
+}
+
+// serveTest runs a handler on a request and returns the recorded response
+func serveTest(h http.HandlerFunc, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	requireAuth(h)(w, r)
+	return w
+}
+
+// upload stores content at p through the upload API
+func upload(t *testing.T, p, content, conflict string) *httptest.ResponseRecorder {
+	t.Helper()
+	target := "/api/upload" + p
+	if conflict != "" {
+		target += "?conflict=" + conflict
+	}
+	return serveTest(handleAPIUpload, http.MethodPut, target, content, nil)
+}
+
+// stored returns the content of a file below the upload directory
+func stored(t *testing.T, p string) string {
+	t.Helper()
+	data, err := readStored(filepath.Join(testUploadPath, p))
+	if err != nil {
+		t.Fatalf("reading %s: %v", p, err)
+	}
+	return string(data)
+}
+
+// exists reports whether a path below the upload directory exists
+func exists(p string) bool {
+	_, err := storage.Stat(filepath.Join(testUploadPath, p))
+	return err == nil
+}
+
+// decode parses a JSON response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+func TestUploadConflictModes(t *testing.T) {
+	useMemoryStorage(t)
+
+	if w := upload(t, "/docs/a.txt", "one", ""); w.Code != http.StatusCreated {
+		t.Fatalf("first upload: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		conflict string
+		status   int
+		path     string // where the content ends up
+	}{
+		{conflictFail, http.StatusConflict, ""},
+		{conflictRename, http.StatusCreated, "/docs/a (1).txt"},
+		{conflictRename, http.StatusCreated, "/docs/a (2).txt"},
+		{conflictOverwrite, http.StatusCreated, "/docs/a.txt"},
+	}
+	for _, tt := range tests {
+		content := "content for " + tt.conflict
+		w := upload(t, "/docs/a.txt", content, tt.conflict)
+		if w.Code != tt.status {
+			t.Fatalf("conflict=%s: status %d, want %d: %s", tt.conflict, w.Code, tt.status, w.Body)
+		}
+		if tt.path != "" {
+			if got := stored(t, tt.path); got != content {
+				t.Errorf("conflict=%s: %s holds %q, want %q", tt.conflict, tt.path, got, content)
+			}
+		}
+	}
+
+	// The overwritten content is kept as a version
+	if n := len(listVersions(filepath.Join(testUploadPath, "docs/a.txt"))); n != 1 {
+		t.Errorf("got %d versions, want 1", n)
+	}
+
+	if w := upload(t, "/docs/a.txt", "x", "bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown conflict policy: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMoveCopyOverwrite(t *testing.T) {
+	useMemoryStorage(t)
+
+	upload(t, "/src.txt", "new", "")
+	upload(t, "/dst.txt", "old", "")
+	upload(t, "/a/b/inner.txt", "inner", "")
+	upload(t, "/x/one.txt", "1", "")
+	upload(t, "/y/two.txt", "2", "")
+	upload(t, "/y/two.txt", "22", "")
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+	}{
+		{"copy without overwrite", handleAPICopy, `{"from":"/src.txt","to":"/dst.txt"}`, http.StatusConflict},
+		{"copy over a file", handleAPICopy, `{"from":"/src.txt","to":"/dst.txt","conflict":"overwrite"}`, http.StatusOK},
+		{"copy onto an ancestor", handleAPICopy, `{"from":"/a/b","to":"/a","conflict":"overwrite"}`, http.StatusBadRequest},
+		{"move onto an ancestor", handleAPIMove, `{"from":"/a/b","to":"/a","conflict":"overwrite"}`, http.StatusBadRequest},
+		{"move a directory over another", handleAPIMove, `{"from":"/x","to":"/y","conflict":"overwrite"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serveTest(tt.handler, http.MethodPost, "/api/", tt.body, nil)
+		if w.Code != tt.status {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	if got := stored(t, "/dst.txt"); got != "new" {
+		t.Errorf("copied file holds %q, want %q", got, "new")
+	}
+	if got := stored(t, "/src.txt"); got != "new" {
+		t.Errorf("copy source holds %q, want %q", got, "new")
+	}
+	versions := listVersions(filepath.Join(testUploadPath, "dst.txt"))
+	if len(versions) != 1 || versions[0].Size != int64(len("old")) {
+		t.Errorf("overwritten file left versions %+v, want the old content", versions)
+	}
+
+	if got := stored(t, "/a/b/inner.txt"); got != "inner" {
+		t.Errorf("refused move changed the source: %q", got)
+	}
+
+	if exists("/x") || !exists("/y/one.txt") || exists("/y/two.txt") {
+		t.Errorf("moved directory did not replace the destination")
+	}
+	items := listTrash()
+	if len(items) != 1 || items[0].Path != "/y" {
+		t.Fatalf("replaced directory is not in the trash: %+v", items)
+	}
+
+	// Restoring the replaced directory brings back its versions
+	body := `{"id":"` + items[0].ID + `","conflict":"overwrite"}`
+	if w := serveTest(handleAPITrash, http.MethodPost, "/api/trash", body, nil); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if got := stored(t, "/y/two.txt"); got != "22" {
+		t.Errorf("restored file holds %q, want %q", got, "22")
+	}
+	if versions := listVersions(filepath.Join(testUploadPath, "y", "two.txt")); len(versions) != 1 {
+		t.Errorf("restored directory has versions %+v, want one", versions)
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	useMemoryStorage(t)
+
+	upload(t, "/notes.txt", "first", "")
+	if w := serveTest(handleAPIFiles, http.MethodDelete, "/api/files?path=/notes.txt", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if exists("/notes.txt") {
+		t.Fatal("deleted file still exists")
+	}
+
+	var list struct {
+		Items []TrashStatus `json:"items"`
+	}
+	decode(t, serveTest(handleAPITrash, http.MethodGet, "/api/trash", "", nil), &list)
+	if len(list.Items) != 1 || list.Items[0].Path != "/notes.txt" {
+		t.Fatalf("trash lists %+v", list.Items)
+	}
+	id := list.Items[0].ID
+
+	// The path was taken again in the meantime
+	upload(t, "/notes.txt", "second", "")
+	restore := func(conflict string) *httptest.ResponseRecorder {
+		return serveTest(handleAPITrash, http.MethodPost, "/api/trash", `{"id":"`+id+`","conflict":"`+conflict+`"}`, nil)
+	}
+	if w := restore(conflictFail); w.Code != http.StatusConflict {
+		t.Fatalf("restore onto an existing file: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := restore(conflictAutorename); w.Code != http.StatusOK {
+		t.Fatalf("restore with autorename: %d %s", w.Code, w.Body)
+	}
+	if got := stored(t, "/notes (1).txt"); got != "first" {
+		t.Errorf("restored file holds %q, want %q", got, "first")
+	}
+	if got := stored(t, "/notes.txt"); got != "second" {
+		t.Errorf("autorename changed the existing file: %q", got)
+	}
+	if items := listTrash(); len(items) != 0 {
+		t.Errorf("restored item is still in the trash: %+v", items)
+	}
+}
+
+func TestVersionRestore(t *testing.T) {
+	useMemoryStorage(t)
+
+	upload(t, "/report.txt", "v1", "")
+	upload(t, "/report.txt", "v2", "")
+
+	var list struct {
+		Versions []VersionStatus `json:"versions"`
+	}
+	decode(t, serveTest(handleAPIVersions, http.MethodGet, "/api/versions?path=/report.txt", "", nil), &list)
+	if len(list.Versions) != 2 || !list.Versions[0].Current {
+		t.Fatalf("versions %+v, want the current one and one previous", list.Versions)
+	}
+
+	body := `{"path":"/report.txt","id":"` + list.Versions[1].ID + `"}`
+	if w := serveTest(handleAPIVersions, http.MethodPost, "/api/versions", body, nil); w.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if got := stored(t, "/report.txt"); got != "v1" {
+		t.Errorf("restored file holds %q, want %q", got, "v1")
+	}
+
+	// What was current before the restore is a version now
+	found := false
+	for _, v := range listVersions(filepath.Join(testUploadPath, "report.txt")) {
+		data, err := readStored(filepath.Join(versionDir(filepath.Join(testUploadPath, "report.txt")), v.ID))
+		found = found || err == nil && string(data) == "v2"
+	}
+	if !found {
+		t.Error("content replaced by the restore was not kept")
+	}
+}
+
+func TestTusResume(t *testing.T) {
+	useMemoryStorage(t)
+
+	tus := map[string]string{"Tus-Resumable": tusVersion}
+	patch := func(location string, offset, chunk string) *httptest.ResponseRecorder {
+		return serveTest(handleTus, http.MethodPatch, location, chunk, map[string]string{
+			"Tus-Resumable": tusVersion,
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		})
+	}
+	offset := func(location string) string {
+		return serveTest(handleTus, http.MethodHead, location, "", tus).Header().Get("Upload-Offset")
+	}
+
+	w := serveTest(handleTus, http.MethodPost, tusBasePath, "", map[string]string{
+		"Tus-Resumable":   tusVersion,
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("big.bin")) + ",path " + base64.StdEncoding.EncodeToString([]byte("/in")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+
+	if w := patch(location, "0", "abcd"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: %d %s", w.Code, w.Body)
+	}
+	if got := offset(location); got != "4" {
+		t.Fatalf("offset after the first chunk is %s, want 4", got)
+	}
+
+	// A client resuming from a wrong offset, or sending too much, changes
+	// nothing
+	if w := patch(location, "2", "cdef"); w.Code != http.StatusConflict {
+		t.Errorf("wrong offset: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := patch(location, "4", "efghijklmnop"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("overlong chunk: status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if got := offset(location); got != "4" {
+		t.Fatalf("offset after refused chunks is %s, want 4", got)
+	}
+	if exists("/in/big.bin") {
+		t.Fatal("file appeared before the upload was complete")
+	}
+
+	if w := patch(location, "4", "efghij"); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	if got := stored(t, "/in/big.bin"); got != "abcdefghij" {
+		t.Errorf("uploaded file holds %q, want %q", got, "abcdefghij")
+	}
+	if got := offset(location); got != "10" {
+		t.Errorf("offset of the completed upload is %s, want 10", got)
+	}
+
+	if w := serveTest(handleTus, http.MethodDelete, location, "", tus); w.Code != http.StatusNoContent {
+		t.Errorf("terminate: %d %s", w.Code, w.Body)
+	}
+	if w := serveTest(handleTus, http.MethodHead, location, "", tus); w.Code != http.StatusNotFound {
+		t.Errorf("terminated upload: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// selfSignedDirName holds the generated certificate in self-signed mode, so
+// browsers only have to accept it once
+const selfSignedDirName = internalPrefix + "tls"
+
+// certReloader serves a certificate from files and picks up changes to them
+// on the next handshake, so renewed certificates apply without a restart
+type certReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// newCertReloader loads a certificate and key, which must be valid
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files if either changed since the last read. A broken
+// pair keeps the previous certificate. c.mu must be held, or c not yet
+// shared.
+func (c *certReloader) reload() error {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if latest.Equal(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.certFile, err)
+	}
+	if c.cert != nil {
+		log.Printf("Reloaded TLS certificate %s", c.certFile)
+	}
+	c.cert = &cert
+	c.modTime = latest
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		log.Printf("Failed to reload TLS certificate, keeping previous one: %v", err)
+	}
+	return c.cert, nil
+}
+
+// tlsEnabled reports whether the server listens with HTTPS
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCert != "" || c.TLSSelfSigned
+}
+
+// loadTLSConfig builds the TLS configuration from the settings, or returns
+// nil when TLS is not enabled
+func loadTLSConfig() (*tls.Config, error) {
+	if !config.tlsEnabled() {
+		return nil, nil
+	}
+
+	certFile, keyFile := config.TLSCert, config.TLSKey
+	if config.TLSSelfSigned {
+		var err error
+		if certFile, keyFile, err = ensureSelfSigned(); err != nil {
+			return nil, fmt.Errorf("failed to create self-signed certificate: %v", err)
+		}
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	// Client certificates are optional, those that are sent must be signed
+	// by the configured CA
+	if config.TLSClientCA != "" {
+		data, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// ensureSelfSigned returns the files of the self-signed certificate,
+// generating a new one if there is none or it is about to expire
+func ensureSelfSigned() (string, string, error) {
+	dir := filepath.Join(config.UploadPath, selfSignedDirName)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 30*24*time.Hour {
+			return certFile, keyFile, nil
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	// Valid for every name the server is likely to be reached by on a LAN
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "File Server", Organization: []string{"File Server self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if host, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return "", "", err
+	}
+	log.Printf("Created self-signed certificate %s", certFile)
+	return certFile, keyFile, nil
+}
+
+// writePEM replaces a file with one PEM block, readable only by the server's
+// user
+func writePEM(path, blockType string, der []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS port
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if config.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(config.Port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+var errCertUnknown = errors.New("Client certificate does not belong to a user")
+
+// certUser returns the user named by the common name of a verified client
+// certificate, nil if there is none, or an error if it names no user
+func certUser(r *http.Request) (*User, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || users == nil {
+		return nil, nil
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	u := users.get(name)
+	if u == nil {
+		return nil, errCertUnknown
+	}
+	return u, nil
+}
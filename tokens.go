@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes, each granting one kind of access
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeMkdir  = "mkdir"
+	scopeDelete = "delete"
+	scopeShare  = "share" // handing out access to others, on top of read or write
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeMkdir, scopeDelete, scopeShare}
+
+// tokenPrefix starts every token, so leaked tokens are easy to search for
+const tokenPrefix = "gofs_"
+
+// APIToken is a personal access token. Only a hash of the secret is kept.
+type APIToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	User     string     `json:"user"`
+	Hash     string     `json:"hash"`
+	Scopes   []string   `json:"scopes"`
+	Paths    []string   `json:"paths,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+
+	lastSaved time.Time // when LastUsed was last written to the file
+}
+
+// TokenStatus is the public view of a token
+type TokenStatus struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	User     string   `json:"user"`
+	Scopes   []string `json:"scopes"`
+	Paths    []string `json:"paths,omitempty"`
+	Created  string   `json:"created"`
+	Expires  string   `json:"expires,omitempty"`
+	LastUsed string   `json:"last_used,omitempty"`
+	Expired  bool     `json:"expired,omitempty"`
+}
+
+// tokenStore holds the tokens from the tokens file. Unlike the users file it
+// is only written by the server.
+type tokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken
+}
+
+// tokens is the token store, nil when tokens are not configured
+var tokens *tokenStore
+
+// loadTokenStore reads the tokens file. A missing file is an empty store.
+func loadTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path, tokens: make(map[string]*APIToken)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tokens []*APIToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, t := range file.Tokens {
+		s.tokens[t.ID] = t
+	}
+	return s, nil
+}
+
+// save writes the store back to the tokens file. s.mu must be held.
+func (s *tokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Created.Before(list[b].Created) })
+
+	return saveJSON(s.path, map[string]interface{}{"tokens": list})
+}
+
+// hashToken returns the stored form of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// lastUsedSaveInterval is how often the last use of a busy token is written
+// to the tokens file
+const lastUsedSaveInterval = time.Minute
+
+// lookup returns the token with the given secret, or nil, recording that it
+// was used
+func (s *tokenStore) lookup(secret string) *APIToken {
+	hash := hashToken(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+			now := time.Now()
+			t.LastUsed = &now
+			if now.Sub(t.lastSaved) >= lastUsedSaveInterval {
+				t.lastSaved = now
+				if err := s.save(); err != nil {
+					log.Printf("Failed to save tokens: %v", err)
+				}
+			}
+			return t
+		}
+	}
+	return nil
+}
+
+// expired reports whether a token is past its expiry date
+func (t *APIToken) expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// allows reports whether the token grants scope on every one of fullPaths
+func (t *APIToken) allows(scope string, fullPaths ...string) bool {
+	granted := false
+	for _, s := range t.Scopes {
+		if s == scope {
+			granted = true
+		}
+	}
+	if !granted {
+		return false
+	}
+	if len(t.Paths) == 0 {
+		return true
+	}
+
+	for _, fullPath := range fullPaths {
+		inside := false
+		for _, p := range t.Paths {
+			if prefix, err := rootView.resolve(p); err == nil && isWithin(fullPath, prefix) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the public view of a token, with its paths as seen in v
+func (t *APIToken) Status(v *view) TokenStatus {
+	var paths []string
+	for _, p := range t.Paths {
+		if fullPath, err := rootView.resolve(p); err == nil {
+			paths = append(paths, v.apiPath(fullPath))
+		}
+	}
+
+	s := TokenStatus{
+		ID:      t.ID,
+		Name:    t.Name,
+		User:    t.User,
+		Scopes:  t.Scopes,
+		Paths:   paths,
+		Created: t.Created.Format(config.TimeFormat),
+		Expired: t.expired(),
+	}
+	if t.Expires != nil {
+		s.Expires = t.Expires.Format(config.TimeFormat)
+	}
+	if t.LastUsed != nil {
+		s.LastUsed = t.LastUsed.Format(config.TimeFormat)
+	}
+	return s
+}
+
+// currentToken returns the API token a request was authenticated with, or nil
+// for passwords and sessions
+func currentToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(tokenKey).(*APIToken)
+	return t
+}
+
+// tokenAllows reports whether the request may use scope on fullPaths. Only
+// API tokens are restricted; passwords and sessions have every scope.
+func tokenAllows(r *http.Request, scope string, fullPaths ...string) bool {
+	t := currentToken(r)
+	return t == nil || t.allows(scope, fullPaths...)
+}
+
+// checkScope is tokenAllows for handlers, sending a 403 when access is denied
+func checkScope(w http.ResponseWriter, r *http.Request, scope string, fullPaths ...string) bool {
+	if tokenAllows(r, scope, fullPaths...) {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	sendJSONError(w, fmt.Sprintf("Token does not grant %s access here", scope), http.StatusForbidden)
+	return false
+}
+
+var errTokenInvalid = errors.New("Invalid or expired token")
+
+// authenticateToken identifies the user of a bearer token
+func authenticateToken(secret string) (*User, *APIToken, error) {
+	if tokens == nil || !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, nil, errTokenInvalid
+	}
+	t := tokens.lookup(secret)
+	if t == nil || t.expired() {
+		return nil, nil, errTokenInvalid
+	}
+	u := users.get(t.User)
+	if u == nil {
+		return nil, nil, errTokenInvalid
+	}
+	return u, t, nil
+}
+
+// parseExpiry parses an optional expiry given as a date, meaning the end of
+// that day, or as a full RFC 3339 timestamp
+func parseExpiry(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	if err != nil {
+		return nil, errors.New("Expires must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+	}
+	if t.Before(time.Now()) {
+		return nil, errors.New("Expires must be in the future")
+	}
+	return &t, nil
+}
+
+// handleAPITokens lists, creates and revokes the caller's API tokens. Tokens
+// themselves cannot be used to manage tokens.
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := currentUser(r)
+	if tokens == nil || user == nil {
+		sendJSONError(w, "API tokens are not enabled", http.StatusNotFound)
+		return
+	}
+	if currentToken(r) != nil {
+		sendJSONError(w, "Tokens cannot be managed with a token", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens.mu.Lock()
+		var mine []*APIToken
+		for _, t := range tokens.tokens {
+			if t.User == user.Name || user.Admin {
+				mine = append(mine, t)
+			}
+		}
+
+		// Newest first
+		sort.Slice(mine, func(a, b int) bool { return mine[a].Created.After(mine[b].Created) })
+		list := []TokenStatus{}
+		for _, t := range mine {
+			list = append(list, t.Status(requestView(r)))
+		}
+		tokens.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"tokens":  list,
+		})
+
+	case http.MethodPost:
+		handleCreateToken(w, r, user)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+
+		tokens.mu.Lock()
+		defer tokens.mu.Unlock()
+		t := tokens.tokens[id]
+		if t == nil || (t.User != user.Name && !user.Admin) {
+			sendJSONError(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		delete(tokens.tokens, id)
+		if err := tokens.save(); err != nil {
+			tokens.tokens[id] = t
+			sendJSONError(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+
+		logf(r, "Revoked token %s (%s) of %s", t.ID, t.Name, t.User)
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: fmt.Sprintf("Token '%s' revoked", t.Name),
+		})
+
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCreateToken issues a new token. The secret is only ever returned here.
+func handleCreateToken(w http.ResponseWriter, r *http.Request, user *User) {
+	var reqBody struct {
+		Name    string   `json:"name"`
+		Scopes  []string `json:"scopes"`
+		Paths   []string `json:"paths"`
+		Expires string   `json:"expires"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.Name == "" {
+		sendJSONError(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Scopes) == 0 {
+		sendJSONError(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, s := range reqBody.Scopes {
+		known := false
+		for _, a := range allScopes {
+			known = known || s == a
+		}
+		if !known {
+			sendJSONError(w, "Scopes must be read, write, mkdir, delete or share", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Paths are stored relative to the upload directory, whatever the
+	// user's view
+	var paths []string
+	for _, p := range reqBody.Paths {
+		fullPath, err := resolvePath(r, p)
+		if err != nil || p == "" {
+			sendJSONError(w, "Invalid path: "+p, http.StatusBadRequest)
+			return
+		}
+		paths = append(paths, rootView.apiPath(fullPath))
+	}
+
+	expires, err := parseExpiry(reqBody.Expires)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := tokenPrefix + randomID()
+	t := &APIToken{
+		ID:      randomID()[:12],
+		Name:    reqBody.Name,
+		User:    user.Name,
+		Hash:    hashToken(secret),
+		Scopes:  reqBody.Scopes,
+		Paths:   paths,
+		Created: time.Now(),
+		Expires: expires,
+	}
+
+	tokens.mu.Lock()
+	tokens.tokens[t.ID] = t
+	err = tokens.save()
+	if err != nil {
+		delete(tokens.tokens, t.ID)
+	}
+	tokens.mu.Unlock()
+	if err != nil {
+		sendJSONError(w, "Failed to save token", http.StatusInternalServerError)
+		return
+	}
+
+	logf(r, "Created token %s (%s) with scopes %s", t.ID, t.Name, strings.Join(t.Scopes, ","))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Token created, copy it now as it will not be shown again",
+		"token":   secret,
+		"info":    t.Status(requestView(r)),
+	})
+}
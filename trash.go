@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashDirName is the directory at the top of the upload directory, and of
+// every home directory, that deleted items are moved into
+const trashDirName = internalPrefix + "trash"
+
+// TrashItem records where a deleted file or directory came from. The item
+// itself is kept next to it in the trash directory, named by its ID.
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"` // original path, relative to the upload directory
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+
+	trash string // trash directory holding the item
+}
+
+// TrashStatus is the public view of a trash item
+type TrashStatus struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	IsDir     bool   `json:"is_dir"`
+	Size      int64  `json:"size"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+	DeletedAt string `json:"deleted_at"`
+	PurgeAt   string `json:"purge_at"`
+}
+
+func (t *TrashItem) dataPath() string    { return filepath.Join(t.trash, t.ID) }
+func (t *TrashItem) infoPath() string    { return filepath.Join(t.trash, t.ID+".json") }
+func (t *TrashItem) sidecarPath() string { return filepath.Join(t.trash, t.ID+trashSidecarSuffix) }
+
+// trashSidecarSuffix names the metadata and versions of an item that was
+// replaced by something else, which are kept next to it in the trash
+const trashSidecarSuffix = ".meta"
+
+// keepSidecar moves the metadata and versions of the path the item was
+// deleted from into the trash, for when something else takes its place
+func (t *TrashItem) keepSidecar(fullPath string) {
+	from := sidecarDir(fullPath)
+	if _, err := storage.Stat(from); err != nil {
+		return
+	}
+	if err := storage.Rename(from, t.sidecarPath()); err != nil {
+		log.Printf("Failed to keep metadata of %s: %v", t.Path, err)
+	}
+}
+
+// returnSidecar puts the metadata and versions kept by keepSidecar back for
+// the path the item is restored to. A file restored over another takes over
+// its versions.
+func (t *TrashItem) returnSidecar(fullPath string) {
+	from, to := t.sidecarPath(), sidecarDir(fullPath)
+	if _, err := storage.Stat(from); err != nil {
+		return
+	}
+	if !t.IsDir {
+		moveFileSidecar(from, to)
+		return
+	}
+	storage.Remove(to)
+	if err := storage.Mkdir(filepath.Dir(to), 0700); err != nil {
+		return
+	}
+	if err := storage.Rename(from, to); err != nil {
+		log.Printf("Failed to restore metadata of %s: %v", t.Path, err)
+	}
+}
+
+// Status returns the public view of a trash item, with its path as seen in v
+func (t *TrashItem) Status(v *view) TrashStatus {
+	s := TrashStatus{
+		ID:        t.ID,
+		Name:      filepath.Base(filepath.FromSlash(t.Path)),
+		Path:      t.Path,
+		IsDir:     t.IsDir,
+		Size:      t.Size,
+		DeletedBy: t.DeletedBy,
+		DeletedAt: t.DeletedAt.Format(config.TimeFormat),
+		PurgeAt:   t.DeletedAt.Add(config.TrashRetention).Format(config.TimeFormat),
+	}
+	if fullPath, err := rootView.resolve(t.Path); err == nil {
+		s.Path = v.apiPath(fullPath)
+	}
+	return s
+}
+
+// trashFor returns the trash directory for a resolved path: the trash of the
+// home directory it is in, or else the one of the upload directory
+func trashFor(fullPath string) string {
+	if config.UserHomes {
+		homes := filepath.Join(config.UploadPath, homesDirName)
+		if rel, err := filepath.Rel(homes, fullPath); err == nil && isWithin(fullPath, homes) {
+			if name, rest, ok := strings.Cut(rel, string(filepath.Separator)); ok && rest != "" {
+				return filepath.Join(homes, name, trashDirName)
+			}
+		}
+	}
+	return filepath.Join(config.UploadPath, trashDirName)
+}
+
+// trashDirs returns every trash directory that may hold items
+func trashDirs() []string {
+	dirs := []string{filepath.Join(config.UploadPath, trashDirName)}
+	if config.UserHomes {
+		homes := filepath.Join(config.UploadPath, homesDirName)
+		entries, _ := storage.List(homes)
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs = append(dirs, filepath.Join(homes, e.Name(), trashDirName))
+			}
+		}
+	}
+	return dirs
+}
+
+// moveToTrash moves a file or directory into its trash and records it
+func moveToTrash(r *http.Request, fullPath string, info fs.FileInfo) (*TrashItem, error) {
+	item := &TrashItem{
+		ID:        randomID(),
+		Path:      rootView.apiPath(fullPath),
+		IsDir:     info.IsDir(),
+		Size:      info.Size(),
+		DeletedAt: time.Now(),
+		trash:     trashFor(fullPath),
+	}
+	if user := currentUser(r); user != nil {
+		item.DeletedBy = user.Name
+	}
+	if item.IsDir {
+		item.Size = treeSize(fullPath)
+	}
+
+	if err := storage.Mkdir(item.trash, 0700); err != nil {
+		return nil, err
+	}
+	if err := saveStored(item.infoPath(), item); err != nil {
+		return nil, err
+	}
+	if err := storage.Rename(fullPath, item.dataPath()); err != nil {
+		storage.Remove(item.infoPath())
+		return nil, err
+	}
+	return item, nil
+}
+
+// treeSize adds up the sizes of the regular files below dir
+func treeSize(dir string) int64 {
+	var size int64
+	walkStorage(dir, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// loadTrashItem reads the record of a trash item. Records whose item is
+// missing are treated as not existing.
+func loadTrashItem(trash, id string) (*TrashItem, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := readStored(filepath.Join(trash, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var item TrashItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	item.trash = trash
+	if _, err := storage.Stat(item.dataPath()); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// listTrash returns every item in the trash, newest first
+func listTrash() []*TrashItem {
+	var items []*TrashItem
+	for _, trash := range trashDirs() {
+		entries, err := storage.List(trash)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			id, ok := strings.CutSuffix(e.Name(), ".json")
+			if !ok {
+				continue
+			}
+			if item, err := loadTrashItem(trash, id); err == nil {
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].DeletedAt.After(items[b].DeletedAt) })
+	return items
+}
+
+// removeTrashItem deletes an item from the trash for good, together with
+// its versions unless something new has taken its place
+func removeTrashItem(item *TrashItem) error {
+	if err := storage.Remove(item.dataPath()); err != nil {
+		return err
+	}
+	storage.Remove(item.sidecarPath())
+	if fullPath, err := rootView.resolve(item.Path); err == nil {
+		if _, err := storage.Stat(fullPath); os.IsNotExist(err) {
+			dropSidecar(fullPath)
+		}
+	}
+	return storage.Remove(item.infoPath())
+}
+
+// purgeTrash removes items that have been in the trash longer than the
+// retention period, and data left without a record
+func purgeTrash() {
+	if config.TrashRetention <= 0 {
+		return
+	}
+	for _, trash := range trashDirs() {
+		entries, err := storage.List(trash)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			id, isRecord := strings.CutSuffix(e.Name(), ".json")
+			item, err := loadTrashItem(trash, id)
+			switch {
+			case err != nil && os.IsNotExist(err):
+				// A record without data, or data without a record, left by
+				// a crash in moveToTrash. Recent ones may still be in use.
+				if time.Since(e.ModTime()) < time.Hour {
+					continue
+				}
+				id = strings.TrimSuffix(e.Name(), trashSidecarSuffix)
+				if isRecord {
+					storage.Remove(filepath.Join(trash, e.Name()))
+				} else if _, err := storage.Stat(filepath.Join(trash, id+".json")); os.IsNotExist(err) {
+					storage.Remove(filepath.Join(trash, e.Name()))
+				}
+			case err == nil && isRecord && time.Since(item.DeletedAt) > config.TrashRetention:
+				if err := removeTrashItem(item); err != nil {
+					log.Printf("Failed to purge %s from the trash: %v", item.Path, err)
+					continue
+				}
+				log.Printf("Purged %s from the trash", item.Path)
+			}
+		}
+	}
+}
+
+// trashVisible reports whether the request's user sees an item in the
+// trash: it must lie in their view, and they must have deleted it or be
+// allowed to delete there
+func trashVisible(r *http.Request, item *TrashItem) (string, bool) {
+	fullPath, err := rootView.resolve(item.Path)
+	if err != nil || !requestView(r).contains(fullPath) {
+		return "", false
+	}
+	user := currentUser(r)
+	if user != nil && item.DeletedBy == user.Name {
+		return fullPath, true
+	}
+	return fullPath, acl.allowed(user, permDelete, fullPath)
+}
+
+// handleAPITrash lists, restores and permanently deletes trash items
+func handleAPITrash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if config.TrashRetention <= 0 {
+		sendJSONError(w, "The trash is not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !checkScope(w, r, scopeRead) {
+			return
+		}
+		list := []TrashStatus{}
+		for _, item := range listTrash() {
+			if _, ok := trashVisible(r, item); ok {
+				list = append(list, item.Status(requestView(r)))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"items":   list,
+		})
+
+	case http.MethodPost:
+		handleRestoreTrash(w, r)
+
+	case http.MethodDelete:
+		if !checkScope(w, r, scopeDelete) {
+			return
+		}
+
+		// Without an id everything the user sees in the trash is removed
+		id := r.URL.Query().Get("id")
+		removed := 0
+		for _, item := range listTrash() {
+			if id != "" && item.ID != id {
+				continue
+			}
+			fullPath, ok := trashVisible(r, item)
+			if !ok || !tokenAllows(r, scopeDelete, fullPath) {
+				continue
+			}
+			if err := removeTrashItem(item); err != nil {
+				sendJSONError(w, "Failed to delete", http.StatusInternalServerError)
+				return
+			}
+			logf(r, "Permanently deleted %s from the trash", item.Path)
+			removed++
+		}
+		if id != "" && removed == 0 {
+			sendJSONError(w, "Item not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: fmt.Sprintf("%d items permanently deleted", removed),
+		})
+
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRestoreTrash moves a trash item back to where it was deleted from
+func handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		ID       string `json:"id"`
+		Conflict string `json:"conflict"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.Conflict == "" {
+		reqBody.Conflict = conflictFail
+	}
+	if reqBody.Conflict != conflictFail && reqBody.Conflict != conflictOverwrite && reqBody.Conflict != conflictAutorename {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or autorename", http.StatusBadRequest)
+		return
+	}
+
+	var item *TrashItem
+	var fullPath string
+	for _, t := range listTrash() {
+		if p, ok := trashVisible(r, t); ok && t.ID == reqBody.ID {
+			item, fullPath = t, p
+			break
+		}
+	}
+	if item == nil {
+		sendJSONError(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	if !checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath) {
+		return
+	}
+
+	if !checkOverwrite(w, r, reqBody.Conflict, fullPath) {
+		return
+	}
+	target, status, err := resolveConflict(fullPath, reqBody.Conflict)
+	if err != nil {
+		sendJSONError(w, err.Error(), status)
+		return
+	}
+	if err := storage.Mkdir(filepath.Dir(target), config.DirPerm); err != nil {
+		sendJSONError(w, "Failed to create directory", http.StatusInternalServerError)
+		return
+	}
+	if err := replacePath(r, item.dataPath(), target); err != nil {
+		sendJSONError(w, "Failed to restore", http.StatusInternalServerError)
+		return
+	}
+	item.returnSidecar(target)
+	storage.Remove(item.infoPath())
+
+	restored := apiPath(r, target)
+	logf(r, "Restored %s from the trash to %s", item.Path, rootView.apiPath(target))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Restored '%s'", restored),
+		"path":    restored,
+	})
+}
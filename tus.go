@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io), with the
+// creation, termination and expiration extensions. Each upload has a staging
+// directory in the storage holding its state and a file for every chunk
+// received, which are joined into the target once the last byte has arrived.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusBasePath   = "/api/tus/"
+	tusDirName    = internalPrefix + "tus"
+	tusInfoName   = "info.json"
+)
+
+// tusUpload is the state of one resumable upload, stored as JSON in its
+// staging directory next to the chunks. Chunks are named after the offset
+// they start at, padded so they sort in order.
+type tusUpload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	Target    string            `json:"target"` // relative to the upload directory
+	User      string            `json:"user,omitempty"`
+	Token     string            `json:"token,omitempty"` // ID of the API token it was created with
+	Conflict  string            `json:"conflict,omitempty"`
+	Checksums checksums         `json:"checksums,omitempty"` // expected digests
+	Expires   time.Time         `json:"expires"`
+	Completed bool              `json:"completed"`
+}
+
+// ownedBy reports whether a request may continue or terminate the upload.
+// Uploads belong to the user that created them, and those created with a
+// token only to that token, like jobs.
+func (u *tusUpload) ownedBy(r *http.Request) bool {
+	name := ""
+	if user := currentUser(r); user != nil {
+		name = user.Name
+	}
+	if u.User != name {
+		return false
+	}
+	t := currentToken(r)
+	return t == nil || u.Token == t.ID
+}
+
+// tusLocks keeps one PATCH or DELETE at a time per upload
+var tusLocks sync.Map
+
+// lockTusUpload takes the lock of an upload, reporting false if another
+// request holds it
+func lockTusUpload(id string) (unlock func(), ok bool) {
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// tusDir returns the staging directory for resumable uploads
+func tusDir() string {
+	return filepath.Join(config.UploadPath, tusDirName)
+}
+
+func (u *tusUpload) dir() string      { return filepath.Join(tusDir(), u.ID) }
+func (u *tusUpload) infoPath() string { return filepath.Join(u.dir(), tusInfoName) }
+
+// chunkPath returns the name of the chunk starting at offset
+func (u *tusUpload) chunkPath(offset int64) string {
+	return filepath.Join(u.dir(), fmt.Sprintf("%020d", offset))
+}
+
+// save writes the upload state to the storage
+func (u *tusUpload) save() error {
+	return saveStored(u.infoPath(), u)
+}
+
+// chunks returns the names of the chunks received so far, in order, and how
+// many bytes they hold together
+func (u *tusUpload) chunks() ([]string, int64, error) {
+	entries, err := storage.List(u.dir())
+	if err != nil {
+		return nil, 0, err
+	}
+	var names []string
+	var size int64
+	for _, e := range entries {
+		// Skip the state and chunks that are still being written
+		if _, err := strconv.ParseUint(e.Name(), 10, 64); err != nil || e.IsDir() {
+			continue
+		}
+		names = append(names, filepath.Join(u.dir(), e.Name()))
+		size += e.Size()
+	}
+	return names, size, nil
+}
+
+// offset returns how many bytes of the upload have been received
+func (u *tusUpload) offset() (int64, error) {
+	if u.Completed {
+		return u.Length, nil
+	}
+	_, size, err := u.chunks()
+	return size, err
+}
+
+// loadTusUpload reads the state of an upload, returning an error satisfying
+// os.IsNotExist for unknown or expired uploads
+func loadTusUpload(id string) (*tusUpload, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := readStored(filepath.Join(tusDir(), id, tusInfoName))
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.Expires) {
+		return nil, os.ErrNotExist
+	}
+	return &u, nil
+}
+
+// removeTusUpload deletes the chunks and state of an upload
+func removeTusUpload(u *tusUpload) {
+	storage.Remove(u.dir())
+}
+
+// handleTus dispatches tus requests. POST to /api/tus/ creates an upload,
+// HEAD, PATCH and DELETE on /api/tus/<id> query, append to and terminate it.
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if config.MaxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		sendJSONError(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	// The target path is checked when the upload is created
+	if !checkScope(w, r, scopeWrite) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		handleTusCreate(w, r)
+	case id != "" && r.Method == http.MethodHead:
+		handleTusHead(w, r, id)
+	case id != "" && r.Method == http.MethodPatch:
+		handleTusPatch(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		handleTusDelete(w, r, id)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTusCreate starts a new upload. The target is given by the "path"
+// (directory) and "filename" metadata entries, and what to do if it exists
+// by the optional "conflict" entry. Expected checksums may be given as
+// "sha256", "md5" and "blake3" entries.
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		sendJSONError(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if config.MaxUploadSize > 0 && length > config.MaxUploadSize {
+		sendJSONError(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		sendJSONError(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(metadata["filename"], "\\", "/")), "/")
+	if name == "" {
+		sendJSONError(w, "Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+	dirPath := metadata["path"]
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	target := path.Join(dirPath, name)
+	conflict, ok := uploadConflict(metadata["conflict"])
+	if !ok {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or rename", http.StatusBadRequest)
+		return
+	}
+	expect := checksums{}
+	for algo := range hashHeaders {
+		if value := metadata[algo]; value != "" {
+			if expect[algo], err = parseChecksum(algo, value); err != nil {
+				sendUploadError(w, err, "", 0)
+				return
+			}
+		}
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, target)
+	if err != nil || isRoot(r, fullPath) {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath) {
+		return
+	}
+	// Refuse before any data is sent; finishTusUpload checks again
+	if _, err := storage.Stat(fullPath); err == nil && conflict == conflictFail {
+		sendUploadError(w, errFileExists, "", 0)
+		return
+	}
+
+	u := &tusUpload{
+		ID:        randomID(),
+		Length:    length,
+		Metadata:  metadata,
+		Target:    rootView.apiPath(fullPath),
+		Conflict:  conflict,
+		Checksums: expect,
+		Expires:   time.Now().Add(config.TusExpiry),
+	}
+	if user := currentUser(r); user != nil {
+		u.User = user.Name
+	}
+	if t := currentToken(r); t != nil {
+		u.Token = t.ID
+	}
+	if err := storage.Mkdir(u.dir(), 0700); err != nil {
+		sendJSONError(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	// An empty file is complete as soon as it is created
+	if length == 0 {
+		if err := finishTusUpload(u); err != nil {
+			removeTusUpload(u)
+			sendUploadError(w, err, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := u.save(); err != nil {
+		removeTusUpload(u)
+		sendJSONError(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", tusBasePath+u.ID)
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleTusHead reports how much of an upload the server has
+func handleTusHead(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	u, err := loadTusUpload(id)
+	if err == nil && !u.ownedBy(r) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		w.WriteHeader(tusErrorStatus(err))
+		return
+	}
+	offset, err := u.offset()
+	if err != nil {
+		w.WriteHeader(tusErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTusPatch appends a chunk at the offset the client claims, which must
+// match what the server already has
+func handleTusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendJSONError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		sendJSONError(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	unlock, ok := lockTusUpload(id)
+	if !ok {
+		sendJSONError(w, "Upload is already in progress", http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	u, err := loadTusUpload(id)
+	if err == nil && !u.ownedBy(r) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		sendJSONError(w, "Upload not found", tusErrorStatus(err))
+		return
+	}
+	if u.Completed {
+		sendJSONError(w, "Upload is already complete", http.StatusForbidden)
+		return
+	}
+	offset, err := u.offset()
+	if err != nil {
+		sendJSONError(w, "Upload not found", tusErrorStatus(err))
+		return
+	}
+	if clientOffset != offset {
+		sendJSONError(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	chunk, err := storage.Create(u.dir(), 0600)
+	if err != nil {
+		sendJSONError(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	defer chunk.Abort()
+
+	// Keep whatever arrived even if the connection drops, so the client can
+	// resume from there. A chunk running past the declared length is
+	// refused as a whole.
+	remaining := u.Length - offset
+	n, copyErr := io.Copy(chunk, io.LimitReader(r.Body, remaining+1))
+	if n > remaining {
+		sendJSONError(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var saveErr error
+	if n > 0 {
+		if saveErr = chunk.Commit(u.chunkPath(offset), false); saveErr == nil {
+			offset += n
+		}
+	}
+
+	if copyErr != nil || saveErr != nil {
+		sendJSONError(w, "Failed to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if offset == u.Length {
+		if err := finishTusUpload(u); err != nil {
+			sendUploadError(w, err, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		if err := u.save(); err != nil {
+			log.Printf("Failed to record completed upload %s: %v", u.ID, err)
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTusDelete terminates an upload and discards its data
+func handleTusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	unlock, ok := lockTusUpload(id)
+	if !ok {
+		sendJSONError(w, "Upload is in progress", http.StatusConflict)
+		return
+	}
+	defer unlock()
+
+	u, err := loadTusUpload(id)
+	if err == nil && !u.ownedBy(r) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		sendJSONError(w, "Upload not found", tusErrorStatus(err))
+		return
+	}
+	removeTusUpload(u)
+	tusLocks.Delete(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a complete upload to its target and marks it done.
+// The state is kept until it expires so clients can still query the offset.
+func finishTusUpload(u *tusUpload) error {
+	fullPath, err := rootView.resolve(u.Target)
+	if err != nil {
+		return &uploadError{"Invalid path", http.StatusBadRequest}
+	}
+	conflict, ok := uploadConflict(u.Conflict)
+	if !ok {
+		conflict = config.UploadConflict
+	}
+	if err := storage.Mkdir(filepath.Dir(fullPath), config.DirPerm); err != nil {
+		return &uploadError{"Failed to create directory", http.StatusInternalServerError}
+	}
+	if info, err := storage.Stat(fullPath); err == nil && info.IsDir() && conflict != conflictRename {
+		return &uploadError{"A directory with that name already exists", http.StatusConflict}
+	}
+
+	chunks, _, err := u.chunks()
+	if err != nil {
+		return err
+	}
+	h := newHasher(u.Checksums)
+	pending, err := joinStored(chunks, filepath.Dir(fullPath), config.FilePerm, h)
+	if err != nil {
+		return err
+	}
+	defer pending.Abort()
+	sums := h.sums()
+	if err := sums.verify(u.Checksums); err != nil {
+		return err
+	}
+
+	internPending(pending, sums[hashSHA256])
+	if fullPath, err = placeFile(pending, fullPath, conflict); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		storage.Remove(chunk)
+	}
+	writeMeta(fullPath, u.User, sums)
+	pruneVersions(fullPath)
+
+	u.Target = rootView.apiPath(fullPath)
+	u.Completed = true
+	log.Printf("Resumable upload %s completed: %s", u.ID, u.Target)
+	return nil
+}
+
+// sweepTusUploads removes uploads that have passed their expiry time
+func sweepTusUploads() {
+	entries, err := storage.List(tusDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		id := e.Name()
+		// Uploads still receiving a chunk are left for the next sweep
+		unlock, ok := lockTusUpload(id)
+		if !ok {
+			continue
+		}
+		if _, err := loadTusUpload(id); os.IsNotExist(err) {
+			removeTusUpload(&tusUpload{ID: id})
+			tusLocks.Delete(id)
+			log.Printf("Removed expired resumable upload %s", id)
+		}
+		unlock()
+	}
+}
+
+// tusErrorStatus maps a staging error to a response status
+func tusErrorStatus(err error) int {
+	if os.IsNotExist(err) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be omitted
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
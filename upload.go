@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxFieldSize limits non-file form fields, which are read into memory
+const maxFieldSize = 64 << 10
+
+// tempPrefix marks in-progress uploads. Files with this prefix are hidden
+// from listings and removed at startup.
+const tempPrefix = internalPrefix + "upload-"
+
+// isTempFile reports whether a file name belongs to an in-progress upload
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// sweepTempFiles removes temp files left behind by uploads that were
+// interrupted by a crash or restart, and directories that were moved aside
+// or copied under a temp name
+func sweepTempFiles() {
+	walkStorage(config.UploadPath, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isTempFile(info.Name()) {
+			if err := storage.Remove(path); err == nil {
+				log.Printf("Removed stale upload %s", path)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+}
+
+// handleAPIUpload handles file uploads. POST /api/upload takes a multipart
+// form, PUT /api/upload/<path> takes the file as the raw request body.
+func handleAPIUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !limitUploadBody(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		handleMultipartUpload(w, r)
+	case http.MethodPut:
+		handleRawUpload(w, r)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxExistsPaths limits how many paths one existence check may ask about
+const maxExistsPaths = 10000
+
+// handleAPIExists tells a client which of the paths it is about to upload to
+// are taken, so it can ask what to do before sending any data. Only paths
+// the user may read or write are reported.
+func handleAPIExists(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		sendJSONError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Paths) > maxExistsPaths {
+		sendJSONError(w, fmt.Sprintf("At most %d paths can be checked at once", maxExistsPaths), http.StatusBadRequest)
+		return
+	}
+
+	type existing struct {
+		Path  string `json:"path"`
+		IsDir bool   `json:"is_dir"`
+	}
+	found := []existing{}
+	u := currentUser(r)
+	for _, p := range reqBody.Paths {
+		// Make sure we're not accessing outside the upload directory
+		fullPath, err := resolvePath(r, p)
+		if err != nil {
+			sendJSONError(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		readable := tokenAllows(r, scopeRead, fullPath) && acl.allowed(u, permRead, fullPath)
+		writable := tokenAllows(r, scopeWrite, fullPath) && acl.allowed(u, permWrite, fullPath)
+		if !readable && !writable {
+			continue
+		}
+		if info, err := storage.Stat(fullPath); err == nil {
+			found = append(found, existing{apiPath(r, fullPath), info.IsDir()})
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"existing": found,
+	})
+}
+
+// limitUploadBody applies the configured maximum upload size to a request
+// body, sending a 413 if the declared length already exceeds it
+func limitUploadBody(w http.ResponseWriter, r *http.Request) bool {
+	if config.MaxUploadSize > 0 {
+		if r.ContentLength > config.MaxUploadSize {
+			sendJSONError(w, "File too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	}
+	return true
+}
+
+// UploadResult reports the outcome for one file of a multipart upload
+type UploadResult struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleMultipartUpload streams every file part of a multipart form straight
+// to storage. The path and conflict fields must come before the file parts, or
+// be given as query parameters. File names may contain a relative path, as
+// sent for folder uploads, which is recreated under the target directory.
+// Expected checksums come from the X-Checksum-* headers, or from sha256, md5
+// and blake3 fields that apply to the file right after them.
+func handleMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	dirPath := r.URL.Query().Get("path")
+	conflict := r.URL.Query().Get("conflict")
+	fields := map[string]*string{"path": &dirPath, "conflict": &conflict}
+	fieldSums := map[string]*string{}
+	for algo := range hashHeaders {
+		fieldSums[algo] = new(string)
+		fields[algo] = fieldSums[algo]
+	}
+
+	receiveMultipart(w, r, &dirPath, fields, func(filePath string, part *multipart.Part) (string, int64, error) {
+		expect, err := expectedChecksums(r)
+		for algo, field := range fieldSums {
+			value := *field
+			*field = ""
+			if value != "" && err == nil {
+				expect[algo], err = parseChecksum(algo, value)
+			}
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		policy, ok := uploadConflict(conflict)
+		if !ok {
+			return "", 0, &uploadError{"Conflict must be one of fail, overwrite or rename", http.StatusBadRequest}
+		}
+
+		if fullPath, err := resolvePath(r, filePath); err == nil && !tokenAllows(r, scopeWrite, fullPath) {
+			return "", 0, &uploadError{"Token does not grant write access here", http.StatusForbidden}
+		} else if err == nil && !acl.allowed(currentUser(r), permWrite, fullPath) {
+			return "", 0, &uploadError{"Permission denied", http.StatusForbidden}
+		}
+		return receiveFile(r, filePath, part, policy, expect)
+	})
+}
+
+// uploadConflict returns the conflict policy for an upload, falling back to
+// the configured default, and whether it is a known one. autorename is
+// accepted as well, as the other endpoints call it.
+func uploadConflict(value string) (string, bool) {
+	switch value {
+	case "":
+		return config.UploadConflict, true
+	case conflictFail, conflictOverwrite, conflictRename:
+		return value, true
+	case conflictAutorename:
+		return conflictRename, true
+	}
+	return "", false
+}
+
+// receiveMultipart reads a multipart form part by part, passing each file to
+// save together with its path below *dirPath, and reports the outcome per
+// file. Form fields named in fields are stored there as they arrive, which
+// may change *dirPath. save returns the path the file was stored as.
+func receiveMultipart(w http.ResponseWriter, r *http.Request, dirPath *string, fields map[string]*string, save func(filePath string, part *multipart.Part) (string, int64, error)) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendJSONError(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	results := []UploadResult{}
+	failed := 0
+	failStatus := 0
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sendUploadError(w, err, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		switch field := fields[part.FormName()]; {
+		case field != nil && part.FileName() == "":
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				sendUploadError(w, err, "Failed to parse form", http.StatusBadRequest)
+				return
+			}
+			*field = string(value)
+
+		case part.FormName() == "file" && part.FileName() != "":
+			if *dirPath == "" {
+				*dirPath = "/"
+			}
+
+			relPath := partRelPath(part)
+			filePath := path.Join(*dirPath, relPath)
+			result := UploadResult{Name: relPath, Path: filePath}
+
+			var n int64
+			var err error
+			if relPath == "" {
+				err = &uploadError{"Invalid file name", http.StatusBadRequest}
+			} else {
+				var saved string
+				saved, n, err = save(filePath, part)
+				if err == nil {
+					result.Path = saved
+				}
+			}
+			if err != nil {
+				// The rest of the body can't be read once the limit is hit
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					sendUploadError(w, err, "", 0)
+					return
+				}
+
+				var uploadErr *uploadError
+				result.Error = "Failed to save file"
+				if errors.As(err, &uploadErr) {
+					result.Error = uploadErr.message
+					if failStatus == 0 {
+						failStatus = uploadErr.status
+					}
+				}
+				failed++
+			} else {
+				result.Size = n
+				result.Success = true
+			}
+			results = append(results, result)
+		}
+		part.Close()
+	}
+
+	if len(results) == 0 {
+		sendJSONError(w, "Failed to get file from form", http.StatusBadRequest)
+		return
+	}
+
+	if failed > 0 {
+		status := http.StatusMultiStatus
+		if failed == len(results) {
+			status = failStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+		}
+		message := fmt.Sprintf("%d of %d files failed to upload", failed, len(results))
+		if len(results) == 1 {
+			message = results[0].Error
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   message,
+			"files":   results,
+		})
+		return
+	}
+
+	message := fmt.Sprintf("%d files uploaded successfully to %s", len(results), *dirPath)
+	if len(results) == 1 {
+		message = fmt.Sprintf("File uploaded successfully to %s", results[0].Path)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": message,
+		"files":   results,
+	})
+}
+
+// partRelPath returns the file name of a multipart part including any
+// relative directories. Part.FileName strips those, so the header is parsed
+// directly. The result is cleaned so it cannot climb out of the target.
+func partRelPath(part *multipart.Part) string {
+	name := part.FileName()
+	if _, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	name = strings.ReplaceAll(name, "\\", "/")
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// handleRawUpload writes the request body to the path after /api/upload/,
+// applying the conflict query parameter
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	filePath := strings.TrimPrefix(r.URL.Path, "/api/upload")
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		sendJSONError(w, "File path is required", http.StatusBadRequest)
+		return
+	}
+	policy, ok := uploadConflict(r.URL.Query().Get("conflict"))
+	if !ok {
+		sendJSONError(w, "Conflict must be one of fail, overwrite or rename", http.StatusBadRequest)
+		return
+	}
+	expect, err := expectedChecksums(r)
+	if err != nil {
+		sendUploadError(w, err, "", 0)
+		return
+	}
+	if fullPath, err := resolvePath(r, filePath); err == nil && (!checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath)) {
+		return
+	}
+
+	filePath, _, err = receiveFile(r, filePath, r.Body, policy, expect)
+	if err != nil {
+		sendUploadError(w, err, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ResponseMessage{
+		Success: true,
+		Message: fmt.Sprintf("File uploaded successfully to %s", filePath),
+	})
+}
+
+// uploadError is an upload failure with the status to report to the client
+type uploadError struct {
+	message string
+	status  int
+}
+
+func (e *uploadError) Error() string { return e.message }
+
+// receiveFile validates an upload target and streams src into it, creating
+// missing parent directories. It returns the path the file was stored at, as
+// the request's user sees it, and the number of bytes written.
+func receiveFile(r *http.Request, filePath string, src io.Reader, conflict string, expect checksums) (string, int64, error) {
+	name := filepath.Base(filePath)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", 0, &uploadError{"Invalid file name", http.StatusBadRequest}
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, filePath)
+	if err != nil || isRoot(r, fullPath) {
+		return "", 0, &uploadError{"Invalid path", http.StatusBadRequest}
+	}
+
+	fullPath, n, err := storeFile(r, fullPath, src, conflict, expect)
+	if err != nil {
+		return "", n, err
+	}
+	return apiPath(r, fullPath), n, nil
+}
+
+// errFileExists is reported when an upload must not replace a file
+var errFileExists = &uploadError{"File already exists", http.StatusConflict}
+
+// storeFile streams src into fullPath, creating missing parent directories.
+// The conflict policy decides what happens if the file exists: overwrite
+// replaces it and keeps the old content as a version, rename stores the
+// upload as "name (1).ext" and so on, and fail refuses it. The content is
+// hashed on the way and refused if it does not match an expected checksum.
+// It returns the path the file was stored at and the number of bytes
+// written.
+func storeFile(r *http.Request, fullPath string, src io.Reader, conflict string, expect checksums) (string, int64, error) {
+	// Make sure the target directory exists
+	if err := storage.Mkdir(filepath.Dir(fullPath), config.DirPerm); err != nil {
+		return "", 0, &uploadError{"Failed to create directory", http.StatusInternalServerError}
+	}
+	if info, err := storage.Stat(fullPath); err == nil && conflict != conflictRename {
+		if info.IsDir() {
+			return "", 0, &uploadError{"A directory with that name already exists", http.StatusConflict}
+		}
+		// Refuse before reading the body; placeFile checks again at the end
+		if conflict == conflictFail {
+			return "", 0, errFileExists
+		}
+	}
+
+	// Write to a pending file that only appears once complete, so a failed
+	// upload never replaces or truncates an existing file
+	pending, err := storage.Create(filepath.Dir(fullPath), config.FilePerm)
+	if err != nil {
+		return "", 0, &uploadError{"Failed to create file on server", http.StatusInternalServerError}
+	}
+	defer pending.Abort()
+
+	// Copy the file to the destination, hashing it on the way
+	h := newHasher(expect)
+	n, err := io.Copy(io.MultiWriter(pending, h), src)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var uploadErr *uploadError
+		if errors.As(err, &maxBytesErr) || errors.As(err, &uploadErr) {
+			return "", n, err
+		}
+		return "", n, &uploadError{"Failed to save file", http.StatusInternalServerError}
+	}
+
+	sums := h.sums()
+	if err := sums.verify(expect); err != nil {
+		return "", n, err
+	}
+
+	internPending(pending, sums[hashSHA256])
+	if fullPath, err = placeFile(pending, fullPath, conflict); err != nil {
+		return "", n, err
+	}
+
+	uploader := ""
+	if u := currentUser(r); u != nil {
+		uploader = u.Name
+	}
+	writeMeta(fullPath, uploader, sums)
+	pruneVersions(fullPath)
+	return fullPath, n, nil
+}
+
+// placeFile commits a finished file to target under a conflict policy,
+// returning the path it ended up at. With overwrite it replaces target,
+// keeping the replaced content as a version. With fail and rename the
+// commit fails rather than replaces when another upload takes the name
+// first; rename then tries the next free name. On error the file is left
+// for the caller to abort.
+func placeFile(pending PendingFile, target, conflict string) (string, error) {
+	if conflict == conflictOverwrite {
+		undo, err := preserveVersion(target)
+		if err != nil {
+			log.Printf("Failed to keep previous version of %s: %v", target, err)
+			return "", &uploadError{"Failed to keep previous version", http.StatusInternalServerError}
+		}
+		if err := pending.Commit(target, true); err != nil {
+			if undo != nil {
+				undo()
+			}
+			return "", &uploadError{"Failed to save file", http.StatusInternalServerError}
+		}
+		return target, nil
+	}
+
+	for {
+		candidate := target
+		if conflict == conflictRename {
+			var err error
+			if candidate, err = uniquePath(target); err != nil {
+				log.Printf("Failed to find a free name for %s: %v", target, err)
+				return "", &uploadError{"Failed to find a free name", http.StatusConflict}
+			}
+		}
+		err := pending.Commit(candidate, false)
+		if err == nil {
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", &uploadError{"Failed to save file", http.StatusInternalServerError}
+		}
+		if conflict != conflictRename {
+			return "", errFileExists
+		}
+	}
+}
+
+// limitedReader fails with a 413 upload error once more than max bytes
+// have been read
+type limitedReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, &uploadError{"File too large", http.StatusRequestEntityTooLarge}
+	}
+	return n, err
+}
+
+// sendUploadError reports an upload failure, using 413 when the body
+// exceeded the configured maximum size
+func sendUploadError(w http.ResponseWriter, err error, message string, statusCode int) {
+	var maxBytesErr *http.MaxBytesError
+	var uploadErr *uploadError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		sendJSONError(w, "File too large", http.StatusRequestEntityTooLarge)
+	case errors.As(err, &uploadErr):
+		sendJSONError(w, uploadErr.message, uploadErr.status)
+	default:
+		sendJSONError(w, message, statusCode)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The versions of a file are kept in versionEntriesName inside its mirrored
+// directory in the sidecar tree
+const versionEntriesName = internalPrefix + "v"
+
+// Version is an earlier content of a file
+type Version struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`     // when this content was written
+	Replaced time.Time `json:"replaced"` // when it was overwritten
+	Uploader string    `json:"uploader,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+}
+
+// VersionStatus is the public view of a version, or of the current content
+type VersionStatus struct {
+	ID       string `json:"id,omitempty"`
+	Current  bool   `json:"current,omitempty"`
+	Size     int64  `json:"size"`
+	Time     string `json:"time"`
+	Uploader string `json:"uploader,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// versionDir returns the directory holding the versions of a file
+func versionDir(fullPath string) string {
+	return filepath.Join(sidecarDir(fullPath), versionEntriesName)
+}
+
+// versionsEnabled reports whether overwritten files are kept
+func versionsEnabled() bool {
+	return config.VersionsKeep > 0
+}
+
+// preserveVersion keeps the current content of fullPath as a version before
+// it is replaced. The content is linked where the storage can, so the
+// following replacement of fullPath leaves it intact. It returns a function
+// that drops the version again if the replacement fails, or nil if there was
+// nothing to keep.
+func preserveVersion(fullPath string) (func(), error) {
+	info, err := storage.Stat(fullPath)
+	if err != nil || !info.Mode().IsRegular() || !versionsEnabled() {
+		return nil, nil
+	}
+
+	v := &Version{
+		ID:       randomID()[:16],
+		Size:     info.Size(),
+		Time:     info.ModTime(),
+		Replaced: time.Now(),
+	}
+	if meta := readMeta(fullPath, info); meta != nil {
+		v.Uploader = meta.Uploader
+		v.SHA256 = meta.Hashes[hashSHA256]
+	}
+
+	dir := versionDir(fullPath)
+	if err := storage.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	data := filepath.Join(dir, v.ID)
+	if err := linkStored(fullPath, data, 0600); err != nil {
+		return nil, err
+	}
+	if v.SHA256 == "" {
+		sums, err := hashFile(data, nil)
+		if err != nil {
+			storage.Remove(data)
+			return nil, err
+		}
+		v.SHA256 = sums[hashSHA256]
+	}
+	if err := saveStored(data+".json", v); err != nil {
+		storage.Remove(data)
+		return nil, err
+	}
+
+	return func() {
+		storage.Remove(data)
+		storage.Remove(data + ".json")
+	}, nil
+}
+
+// listVersions returns the versions of a file, newest first
+func listVersions(fullPath string) []*Version {
+	dir := versionDir(fullPath)
+	entries, err := storage.List(dir)
+	if err != nil {
+		return nil
+	}
+	var versions []*Version
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if v, err := loadVersion(fullPath, id); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(a, b int) bool { return versions[a].Replaced.After(versions[b].Replaced) })
+	return versions
+}
+
+// loadVersion reads the record of one version of a file, returning an error
+// satisfying os.IsNotExist for unknown versions
+func loadVersion(fullPath, id string) (*Version, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+	dir := versionDir(fullPath)
+	data, err := readStored(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var v Version
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if _, err := storage.Stat(filepath.Join(dir, id)); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// removeVersion deletes one version of a file
+func removeVersion(fullPath string, v *Version) {
+	data := filepath.Join(versionDir(fullPath), v.ID)
+	storage.Remove(data)
+	storage.Remove(data + ".json")
+}
+
+// pruneVersions applies the retention rules to the versions of a file:
+// only the newest versions-keep are kept, and none older than
+// versions-max-age if that is set
+func pruneVersions(fullPath string) {
+	for i, v := range listVersions(fullPath) {
+		if i >= config.VersionsKeep || (config.VersionsMaxAge > 0 && time.Since(v.Replaced) > config.VersionsMaxAge) {
+			removeVersion(fullPath, v)
+		}
+	}
+}
+
+// pruneAllVersions applies the retention rules to every file, and drops the
+// versions of files that no longer exist once they have all expired
+func pruneAllVersions() {
+	root := filepath.Join(config.UploadPath, sidecarDirName)
+	walkStorage(root, func(p string, info fs.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || info.Name() != versionEntriesName {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return filepath.SkipDir
+		}
+		fullPath := filepath.Join(config.UploadPath, rel)
+		pruneVersions(fullPath)
+		if len(listVersions(fullPath)) == 0 {
+			if _, err := storage.Stat(fullPath); os.IsNotExist(err) {
+				storage.Remove(p)
+			}
+		}
+		return filepath.SkipDir
+	})
+}
+
+// handleAPIVersions lists, restores and deletes the versions of a file.
+// Versions are downloaded with /download/<path>?version=<id>.
+func handleAPIVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !versionsEnabled() {
+		sendJSONError(w, "Versioning is not enabled", http.StatusNotFound)
+		return
+	}
+
+	filePath := r.URL.Query().Get("path")
+	if r.Method == http.MethodPost {
+		var reqBody struct {
+			Path string `json:"path"`
+			ID   string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			sendJSONError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		handleRestoreVersion(w, r, reqBody.Path, reqBody.ID)
+		return
+	}
+
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, filePath)
+	if err != nil || filePath == "" {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !checkScope(w, r, scopeRead, fullPath) || !checkAccess(w, r, permRead, fullPath) {
+			return
+		}
+		info, err := storage.Stat(fullPath)
+		if err != nil || info.IsDir() {
+			sendJSONError(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		current := VersionStatus{
+			Current: true,
+			Size:    info.Size(),
+			Time:    info.ModTime().Format(config.TimeFormat),
+		}
+		if meta := readMeta(fullPath, info); meta != nil {
+			current.Uploader = meta.Uploader
+			current.SHA256 = meta.Hashes[hashSHA256]
+		}
+		list := []VersionStatus{current}
+		for _, v := range listVersions(fullPath) {
+			list = append(list, VersionStatus{
+				ID:       v.ID,
+				Size:     v.Size,
+				Time:     v.Time.Format(config.TimeFormat),
+				Uploader: v.Uploader,
+				SHA256:   v.SHA256,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"path":     apiPath(r, fullPath),
+			"versions": list,
+		})
+
+	case http.MethodDelete:
+		if !checkScope(w, r, scopeDelete, fullPath) || !checkAccess(w, r, permDelete, fullPath) {
+			return
+		}
+		v, err := loadVersion(fullPath, r.URL.Query().Get("id"))
+		if err != nil {
+			sendJSONError(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		removeVersion(fullPath, v)
+		logf(r, "Deleted version %s of %s", v.ID, rootView.apiPath(fullPath))
+		json.NewEncoder(w).Encode(ResponseMessage{
+			Success: true,
+			Message: "Version deleted",
+		})
+
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRestoreVersion makes a version the current content of its file. The
+// content it replaces is kept as a version in turn.
+func handleRestoreVersion(w http.ResponseWriter, r *http.Request, filePath, id string) {
+	// Make sure we're not accessing outside the upload directory
+	fullPath, err := resolvePath(r, filePath)
+	if err != nil || filePath == "" || isRoot(r, fullPath) {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if !checkScope(w, r, scopeWrite, fullPath) || !checkAccess(w, r, permWrite, fullPath) {
+		return
+	}
+	v, err := loadVersion(fullPath, id)
+	if err != nil {
+		sendJSONError(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	src, err := storage.Open(filepath.Join(versionDir(fullPath), v.ID))
+	if err != nil {
+		sendJSONError(w, "Failed to read version", http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	// Make sure the stored copy is intact
+	var expect checksums
+	if v.SHA256 != "" {
+		expect = checksums{hashSHA256: v.SHA256}
+	}
+	if _, _, err := storeFile(r, fullPath, src, conflictOverwrite, expect); err != nil {
+		sendUploadError(w, err, "Failed to restore version", http.StatusInternalServerError)
+		return
+	}
+
+	logf(r, "Restored version %s of %s", v.ID, rootView.apiPath(fullPath))
+	json.NewEncoder(w).Encode(ResponseMessage{
+		Success: true,
+		Message: fmt.Sprintf("Restored the version of %s", v.Time.Format(config.TimeFormat)),
+	})
+}
+
+// serveVersion sends an earlier version of a file for download
+func serveVersion(w http.ResponseWriter, r *http.Request, fullPath, id string) {
+	v, err := loadVersion(fullPath, id)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	ext := filepath.Ext(fullPath)
+	name := strings.TrimSuffix(filepath.Base(fullPath), ext) + " (" + v.Time.Format("2006-01-02 150405") + ")" + ext
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	setDigestHeaders(w, checksums{hashSHA256: v.SHA256})
+	serveStored(w, r, filepath.Join(versionDir(fullPath), v.ID))
+}
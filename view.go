@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// homesDirName is the directory below the upload directory holding the
+// users' home directories
+const homesDirName = "users"
+
+// Mount makes a directory appear at Path in the views of the listed users
+// and members of the listed ACL groups
+type Mount struct {
+	Path   string   `json:"path"`   // top-level name it appears as, e.g. "/team-a"
+	Source string   `json:"source"` // directory below the upload directory
+	Users  []string `json:"users"`  // user names, "*" for everyone
+	Groups []string `json:"groups"` // ACL group names
+}
+
+// mountPoint is a directory shown at a path of a view
+type mountPoint struct {
+	path string // slash-separated path in the view
+	dir  string // real directory
+}
+
+// view maps the paths a user sees onto directories below the upload
+// directory. "/" is always mounted.
+type view struct {
+	mounts []mountPoint // longest path first
+}
+
+// rootView shows the upload directory itself, as seen by admins and when
+// authentication or home directories are disabled
+var rootView = &view{}
+
+// rootMounts returns the mounts of a view, defaulting to the upload directory
+func (v *view) rootMounts() []mountPoint {
+	if len(v.mounts) == 0 {
+		return []mountPoint{{"/", config.UploadPath}}
+	}
+	return v.mounts
+}
+
+// resolve maps a path from a request onto the directory it is mounted from
+// and makes sure the result does not escape it
+func (v *view) resolve(p string) (string, error) {
+	cleaned := filepath.ToSlash(filepath.Clean(p))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.New("path outside upload directory")
+	}
+	viewPath := path.Clean("/" + cleaned)
+
+	for _, m := range v.rootMounts() {
+		rel, ok := strings.CutPrefix(viewPath, m.path)
+		if !ok || (rel != "" && !strings.HasPrefix(rel, "/") && m.path != "/") {
+			continue
+		}
+
+		// The server's own bookkeeping is not reachable through the API
+		for _, part := range strings.Split(rel, "/") {
+			if isInternalName(part) {
+				return "", errors.New("path refers to internal data")
+			}
+		}
+
+		fullPath := filepath.Join(m.dir, filepath.FromSlash(rel))
+		if !isWithin(fullPath, m.dir) {
+			return "", errors.New("path outside upload directory")
+		}
+		return fullPath, nil
+	}
+	return "", errors.New("path outside upload directory")
+}
+
+// apiPath converts a resolved path back into the slash-separated form used
+// by the API
+func (v *view) apiPath(fullPath string) string {
+	// The deepest directory containing the path gives the shortest result
+	best := ""
+	result := "/"
+	for _, m := range v.rootMounts() {
+		if !isWithin(fullPath, m.dir) || len(m.dir) < len(best) {
+			continue
+		}
+		rel, err := filepath.Rel(m.dir, fullPath)
+		if err != nil {
+			continue
+		}
+		best = m.dir
+		result = path.Join(m.path, filepath.ToSlash(rel))
+	}
+	return result
+}
+
+// isRoot reports whether a resolved path is the root of the view or a mount
+// point, none of which can be deleted or moved
+func (v *view) isRoot(fullPath string) bool {
+	for _, m := range v.rootMounts() {
+		if filepath.Clean(fullPath) == filepath.Clean(m.dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether a resolved path can be reached in the view
+func (v *view) contains(fullPath string) bool {
+	for _, m := range v.rootMounts() {
+		if isWithin(fullPath, m.dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountsIn returns the mount points shown directly inside a directory of the
+// view, by name
+func (v *view) mountsIn(dirPath string) map[string]mountPoint {
+	found := make(map[string]mountPoint)
+	dirPath = path.Clean("/" + filepath.ToSlash(dirPath))
+	for _, m := range v.mounts {
+		if m.path != "/" && path.Dir(m.path) == dirPath {
+			found[path.Base(m.path)] = m
+		}
+	}
+	return found
+}
+
+// homeDir returns the real home directory of a user
+func homeDir(name string) string {
+	return filepath.Join(config.UploadPath, homesDirName, name)
+}
+
+// validUserName reports whether a name can be used as a home directory
+func validUserName(name string) bool {
+	return name != "" && name != "." && name != ".." && !isInternalName(name) &&
+		!strings.ContainsAny(name, `/\:`)
+}
+
+// userView builds the view of a user: their home directory with the mounts
+// they are given. Admins see the whole upload directory.
+func userView(u *User) *view {
+	if u == nil || u.Admin || !config.UserHomes || !validUserName(u.Name) {
+		return rootView
+	}
+
+	home := homeDir(u.Name)
+	if err := storage.Mkdir(home, config.DirPerm); err != nil {
+		log.Printf("Failed to create home directory for %s: %v", u.Name, err)
+	}
+	v := &view{mounts: []mountPoint{{"/", home}}}
+
+	var groups map[string][]string
+	if acl != nil {
+		_, groups = acl.current()
+	}
+	for _, m := range users.mountsFor(u, groups) {
+		mountPath := path.Clean("/" + m.Path)
+		dir, err := rootView.resolve(m.Source)
+		if err != nil || mountPath == "/" || path.Dir(mountPath) != "/" || isInternalName(path.Base(mountPath)) {
+			log.Printf("Ignoring invalid mount %s -> %s", m.Path, m.Source)
+			continue
+		}
+		if err := storage.Mkdir(dir, config.DirPerm); err != nil {
+			log.Printf("Failed to create mount source %s: %v", m.Source, err)
+			continue
+		}
+		v.mounts = append(v.mounts, mountPoint{mountPath, dir})
+	}
+
+	sort.SliceStable(v.mounts, func(i, j int) bool { return len(v.mounts[i].path) > len(v.mounts[j].path) })
+	return v
+}
+
+// requestView returns the view of the request's user
+func requestView(r *http.Request) *view {
+	if v, ok := r.Context().Value(viewKey).(*view); ok {
+		return v
+	}
+	return rootView
+}
+
+// withView attaches the view of a user to a request's context
+func withView(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, viewKey, userView(u))
+}
+
+// resolvePath maps a path from a request onto the upload directory, as seen
+// by the request's user, and makes sure the result does not escape it
+func resolvePath(r *http.Request, p string) (string, error) {
+	return requestView(r).resolve(p)
+}
+
+// apiPath converts a resolved path back into the form the request's user
+// sees it in
+func apiPath(r *http.Request, fullPath string) string {
+	return requestView(r).apiPath(fullPath)
+}
+
+// isRoot reports whether a resolved path is the root of the request's view
+// or one of its mount points
+func isRoot(r *http.Request, fullPath string) bool {
+	return requestView(r).isRoot(fullPath)
+}